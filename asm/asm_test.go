@@ -133,3 +133,29 @@ testStrings:6:13: string can only be used after a .dat directive`
 		t.Fatalf("\nExpected:\n%s\nGot:\n%s", exp, s)
 	}
 }
+
+func TestAssembleProgram(t *testing.T) {
+	prog, err := asm.AssembleProgram("prog", strings.NewReader(`.equ SIZE 2
+.opcode sqrt -42
+:start	lit buf SIZE
+	sqrt
+:1	loop 1-
+.org 10
+:buf	.dat "ab"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var syms []string
+	for _, s := range prog.Symbols {
+		syms = append(syms, fmt.Sprintf("%v %s %d %s", s.Kind, s.Name, s.Value, s.Pos))
+	}
+	exp := "[label start 0 prog:3:1 label 1·1 5 prog:5:1 label buf 10 prog:7:1 const SIZE 2 prog:1:6 opcode sqrt -42 prog:2:9]"
+	if s := fmt.Sprintf("%v", syms); s != exp {
+		t.Errorf("\nExpected:\n%s\nGot:\n%s", exp, s)
+	}
+	exp = "[{0 4 3} {4 1 4} {5 2 5} {10 3 7}]"
+	if s := fmt.Sprintf("%v", prog.Lines); s != exp {
+		t.Errorf("\nExpected:\n%s\nGot:\n%s", exp, s)
+	}
+}
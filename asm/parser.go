@@ -74,6 +74,8 @@ type parser struct {
 	cstPos  scanner.Position
 	errs    ErrAsm
 	opcodes map[string]vm.Cell
+	custOps map[string]labelSite
+	lines   []SourceRange
 }
 
 func newParser() *parser {
@@ -82,6 +84,7 @@ func newParser() *parser {
 	p.locCtr = make(map[int]int)
 	p.consts = make(map[string]labelSite)
 	p.opcodes = make(map[string]vm.Cell)
+	p.custOps = make(map[string]labelSite)
 	for i, v := range opcodes {
 		for _, n := range v {
 			p.opcodes[n] = vm.Cell(i)
@@ -115,11 +118,17 @@ func (p *parser) abort() bool { return len(p.errs) >= maxErrors }
 
 // write is the actual compilation function. It emits the given value at the
 // current compile address, then imcrements it. It also takes care of managing
-// the memory image size.
+// the memory image size and records the source line of the emitted cell.
 func (p *parser) write(v vm.Cell) {
 	for p.pc >= len(p.i) {
 		p.i = append(p.i, make([]vm.Cell, 16384)...)
 	}
+	line := p.s.Position.Line
+	if n := len(p.lines); n > 0 && p.lines[n-1].Line == line && p.lines[n-1].Addr+p.lines[n-1].Count == p.pc {
+		p.lines[n-1].Count++
+	} else {
+		p.lines = append(p.lines, SourceRange{Addr: p.pc, Count: 1, Line: line})
+	}
 	p.i[p.pc] = v
 	p.pc++
 }
@@ -305,6 +314,7 @@ func (p *parser) Parse(name string, r io.Reader) ([]vm.Cell, error) {
 			case 4:
 				// .opcode
 				p.opcodes[p.cstName] = vm.Cell(v)
+				p.custOps[p.cstName] = labelSite{p.cstPos, v}
 			case 0:
 				// implicit lit
 				p.write(vm.OpLit)
@@ -418,6 +428,7 @@ func (p *parser) Parse(name string, r io.Reader) ([]vm.Cell, error) {
 						p.cstPos = p.s.Position
 						state = 3
 					} else {
+						p.cstPos = p.s.Position
 						state = 4
 					}
 				default:
@@ -0,0 +1,108 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asm
+
+import (
+	"io"
+	"sort"
+	"text/scanner"
+
+	"github.com/dobegor/ngaro/vm"
+)
+
+// SymbolKind is the kind of a Symbol.
+type SymbolKind int
+
+// Symbol kinds.
+const (
+	Label SymbolKind = iota
+	Const
+	Opcode
+)
+
+var kindNames = [...]string{"label", "const", "opcode"}
+
+// String returns the name of the symbol kind as used in assembler maps.
+func (k SymbolKind) String() string {
+	if k < 0 || int(k) >= len(kindNames) {
+		return "unknown"
+	}
+	return kindNames[k]
+}
+
+// Symbol is a label, constant or custom opcode defined in an assembler source.
+// Local labels are named after their internal unique name (see the package
+// documentation).
+type Symbol struct {
+	Name  string
+	Kind  SymbolKind
+	Value int              // address of a label or value of a constant or opcode
+	Pos   scanner.Position // position of the definition
+}
+
+// SourceRange maps a range of consecutive cells in an assembled image to the
+// source line that produced them. A single source line may produce several
+// ranges if it uses the .org directive.
+type SourceRange struct {
+	Addr  int // address of the first cell
+	Count int // number of cells
+	Line  int // source line number, starting at 1
+}
+
+// Program is the result of AssembleProgram: a memory image along with the
+// debugging information collected during assembly.
+type Program struct {
+	Name    string        // source name, as passed to AssembleProgram
+	Image   []vm.Cell     // assembled memory image
+	Symbols []Symbol      // symbols ordered by kind, then value and name
+	Lines   []SourceRange // cell ranges in the order they were emitted
+}
+
+// AssembleProgram works like Assemble but also returns the symbols defined in
+// the source and a map from image addresses to source lines, which can be used
+// to produce assembler listings or symbol maps.
+//
+// Custom opcodes are reported only if defined with the .opcode directive, and
+// constants that are redefined are reported with their last value.
+func AssembleProgram(name string, r io.Reader) (*Program, error) {
+	p := newParser()
+	img, err := p.Parse(name, r)
+	if err != nil {
+		return nil, err
+	}
+	prog := &Program{Name: name, Image: img, Lines: p.lines}
+	for n, l := range p.labels {
+		prog.Symbols = append(prog.Symbols, Symbol{n, Label, l.address, l.pos})
+	}
+	for n, c := range p.consts {
+		prog.Symbols = append(prog.Symbols, Symbol{n, Const, c.address, c.pos})
+	}
+	for n, c := range p.custOps {
+		prog.Symbols = append(prog.Symbols, Symbol{n, Opcode, c.address, c.pos})
+	}
+	sort.Slice(prog.Symbols, func(i, j int) bool {
+		a, b := &prog.Symbols[i], &prog.Symbols[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Value != b.Value {
+			return a.Value < b.Value
+		}
+		return a.Name < b.Name
+	})
+	return prog, nil
+}
@@ -0,0 +1,260 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command ngaro runs Ngaro VM images and assembler sources.
+//
+// Usage:
+//
+//	ngaro [flags] file
+//
+// If the file name ends with .asm, it is assembled with the asm package before
+// being run, otherwise it is loaded as a memory image with vm.LoadImage. Raw
+// images use the cell width given by the -bits flag. For image files in the
+// self-describing format, execution starts at the image's entry point and the
+// stack sizes default to the ones requested by the image.
+//
+// The VM console is connected to the standard input and output. Output uses
+// VT100 escape sequences and reports the size of the terminal to the VM.
+// Include files given with -i are read by the VM, in order, before the standard
+// input.
+//
+// Saving the image from the VM writes it to the file given with -save. It
+// defaults to the image file itself, or, for assembler sources, to the source
+// file name with an .img extension.
+//
+// The -trace flag writes a trace of every instruction executed, along with the
+// data stack, to the given file, or to the standard error if the file name is
+// "-". CPU profiling of the VM itself is enabled with -cpuprofile.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"strings"
+	"time"
+
+	"github.com/dobegor/ngaro/asm"
+	"github.com/dobegor/ngaro/vm"
+	"github.com/pkg/errors"
+)
+
+// fileList is a flag.Value collecting the values of a repeated flag.
+type fileList []string
+
+func (l *fileList) String() string     { return strings.Join(*l, ",") }
+func (l *fileList) Set(v string) error { *l = append(*l, v); return nil }
+
+var (
+	memSize    = flag.Int("size", 1000000, "minimum memory `size` in cells")
+	cellBits   = flag.Int("bits", 32, "cell width of image files, 32 or 64 `bits`")
+	dataSize   = flag.Int("ds", 0, "data stack `size` in cells (0 for the image or VM default)")
+	addrSize   = flag.Int("as", 0, "address stack `size` in cells (0 for the image or VM default)")
+	clock      = flag.Float64("clock", 0, "simulated clock `frequency` in Hz (0 means unlimited)")
+	saveFile   = flag.String("save", "", "`file` name used when the VM saves its image")
+	traceFile  = flag.String("trace", "", "write an instruction trace to `file` (- for stderr)")
+	cpuProfile = flag.String("cpuprofile", "", "write a CPU profile to `file`")
+	stats      = flag.Bool("stats", false, "print the instruction count and speed on exit")
+	includes   fileList
+)
+
+func init() {
+	flag.Var(&includes, "i", "include `file` read before the standard input (can be repeated)")
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] file\n\nflags:\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(flag.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "ngaro: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// load loads or assembles fileName into a memory of at least size cells and
+// returns it along with the default image save file name.
+func load(fileName string, size int) (*vm.Image, string, error) {
+	if filepath.Ext(fileName) != ".asm" {
+		img, err := vm.LoadImage(fileName, size, *cellBits)
+		return img, fileName, err
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "open failed")
+	}
+	defer f.Close()
+	img, err := asm.Assemble(fileName, f)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(img) < size {
+		img = append(img, make([]vm.Cell, size-len(img))...)
+	}
+	return &vm.Image{Mem: img, CellBits: *cellBits, Raw: true}, strings.TrimSuffix(fileName, ".asm") + ".img", nil
+}
+
+func run(fileName string) (err error) {
+	img, save, err := load(fileName, *memSize)
+	if err != nil {
+		return err
+	}
+	if *saveFile != "" {
+		save = *saveFile
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer func() {
+		if e := out.Flush(); err == nil {
+			err = e
+		}
+	}()
+	opts := []vm.Option{
+		vm.FromImage(img),
+		vm.Output(vm.NewVT100Terminal(out, out.Flush, termSize)),
+		vm.Input(&flushReader{os.Stdin, out}),
+		vm.SaveMemImage(func(name string, mem []vm.Cell) error {
+			if img.Raw {
+				return vm.Save(name, mem, *cellBits)
+			}
+			// keep the metadata of self-describing images
+			s := *img
+			s.Mem = mem
+			return vm.SaveImage(name, &s)
+		}),
+	}
+	if *dataSize > 0 {
+		opts = append(opts, vm.DataSize(*dataSize))
+	}
+	if *addrSize > 0 {
+		opts = append(opts, vm.AddressSize(*addrSize))
+	}
+
+	var trace *bufio.Writer
+	if *traceFile != "" {
+		w := os.Stderr
+		if *traceFile != "-" {
+			if w, err = os.Create(*traceFile); err != nil {
+				return errors.Wrap(err, "trace")
+			}
+			defer w.Close()
+		}
+		trace = bufio.NewWriter(w)
+		defer trace.Flush()
+	}
+	if tick := ticker(trace); tick != nil {
+		opts = append(opts, tick)
+	}
+
+	i, err := vm.New(img.Mem, save, opts...)
+	if err != nil {
+		return err
+	}
+	// the first include file must be on top of the input stack
+	for k := len(includes) - 1; k >= 0; k-- {
+		f, err := os.Open(includes[k])
+		if err != nil {
+			return errors.Wrap(err, "include")
+		}
+		defer f.Close()
+		i.PushInput(f)
+	}
+
+	if *cpuProfile != "" {
+		f, err := os.Create(*cpuProfile)
+		if err != nil {
+			return errors.Wrap(err, "cpuprofile")
+		}
+		defer f.Close()
+		if err = pprof.StartCPUProfile(f); err != nil {
+			return errors.Wrap(err, "cpuprofile")
+		}
+		defer pprof.StopCPUProfile()
+	}
+
+	if trace != nil {
+		traceIns(trace, i)
+	}
+	start := time.Now()
+	err = i.Run()
+	out.Flush()
+	if *stats {
+		d := time.Since(start)
+		n := i.InstructionCount()
+		fmt.Fprintf(os.Stderr, "%d instructions in %v (%.2f MIPS)\n", n, d, float64(n)/d.Seconds()/1e6)
+	}
+	if errors.Cause(err) == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// ticker returns the Ticker option for the clock limiter and tracing, or nil
+// if neither is enabled.
+func ticker(trace *bufio.Writer) vm.Option {
+	var limit func(*vm.Instance)
+	var ticks int64
+	if *clock > 0 {
+		limit, ticks = vm.ClockLimiter(time.Duration(float64(time.Second) / *clock), 0)
+	}
+	switch {
+	case trace != nil:
+		return vm.Ticker(func(i *vm.Instance) {
+			traceIns(trace, i)
+			if limit != nil && i.InstructionCount()&(ticks-1) == 0 {
+				limit(i)
+			}
+		}, 1)
+	case limit != nil:
+		return vm.Ticker(limit, ticks)
+	}
+	return nil
+}
+
+// traceIns writes the address and disassembly of the next instruction to be
+// executed by i, followed by the data stack.
+func traceIns(w io.Writer, i *vm.Instance) {
+	if i.PC < 0 || i.PC >= len(i.Mem) {
+		return
+	}
+	fmt.Fprintf(w, "% 10d\t", i.PC)
+	asm.Disassemble(i.Mem, i.PC, w)
+	fmt.Fprintf(w, "\t%v\n", i.Data())
+}
+
+// flushReader flushes pending output before reading input so that prompts are
+// displayed before the VM blocks.
+type flushReader struct {
+	r   io.Reader
+	out *bufio.Writer
+}
+
+func (f *flushReader) Read(b []byte) (int, error) {
+	if err := f.out.Flush(); err != nil {
+		return 0, err
+	}
+	return f.r.Read(b)
+}
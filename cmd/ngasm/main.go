@@ -0,0 +1,234 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command ngasm assembles Ngaro VM assembler sources into memory images.
+//
+// Usage:
+//
+//	ngasm [flags] file.asm
+//
+// The image is written with vm.Save to the file given with -o, which defaults
+// to the source file name with an .img extension. The -bits flag sets the cell
+// width of the image file.
+//
+// With -meta, a self-describing image is written with vm.SaveImage instead. It
+// includes the symbols and source map of the program, along with a checksum,
+// and records the instruction set extensions used by the program. Such images
+// can be loaded with vm.Load, or with vm.LoadImage to get the symbols and
+// source map, but not by other Ngaro VM implementations.
+//
+// The -l flag writes an assembler listing, where each source line is preceded
+// by the address of the cells it produced and their values. The -m flag writes
+// a symbol map with one label, constant or custom opcode per line, giving its
+// kind, name, value and the position of its definition.
+//
+// Assembly errors are reported on the standard error, one per line, in the
+// file:line:col: message format.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dobegor/ngaro/asm"
+	"github.com/dobegor/ngaro/vm"
+	"github.com/pkg/errors"
+)
+
+// maximum number of cells per listing line.
+const listCells = 4
+
+var (
+	outFile  = flag.String("o", "", "write the image to `file`")
+	cellBits = flag.Int("bits", 32, "cell width of the image file, 32 or 64 `bits`")
+	meta     = flag.Bool("meta", false, "write a self-describing image with symbols, source map and checksum")
+	listFile = flag.String("l", "", "write an assembler listing to `file`")
+	mapFile  = flag.String("m", "", "write a symbol map to `file`")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] file.asm\n\nflags:\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(flag.Arg(0)); err != nil {
+		if _, ok := err.(asm.ErrAsm); !ok {
+			err = errors.Wrap(err, "ngasm")
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(fileName string) error {
+	src, err := os.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	prog, err := asm.AssembleProgram(fileName, bytes.NewReader(src))
+	if err != nil {
+		return err
+	}
+	out := *outFile
+	if out == "" {
+		out = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".img"
+	}
+	if *meta {
+		err = vm.SaveImage(out, image(prog))
+	} else {
+		err = vm.Save(out, prog.Image, *cellBits)
+	}
+	if err != nil {
+		return err
+	}
+	if *listFile != "" {
+		if err = writeFile(*listFile, func(w io.Writer) error { return writeListing(w, prog, src) }); err != nil {
+			return err
+		}
+	}
+	if *mapFile != "" {
+		if err = writeFile(*mapFile, func(w io.Writer) error { return writeMap(w, prog) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// image returns prog as a vm.Image with symbols, source map and checksum.
+func image(prog *asm.Program) *vm.Image {
+	img := &vm.Image{
+		Mem:      prog.Image,
+		CellBits: *cellBits,
+		ISA:      isa(prog.Image),
+		Source:   prog.Name,
+		Checksum: true,
+	}
+	for _, s := range prog.Symbols {
+		img.Symbols = append(img.Symbols, vm.Symbol{Name: s.Name, Kind: uint8(s.Kind), Value: vm.Cell(s.Value)})
+	}
+	for _, l := range prog.Lines {
+		img.SourceMap = append(img.SourceMap, vm.SourceLine{Addr: l.Addr, Count: l.Count, Line: l.Line})
+	}
+	return img
+}
+
+// isa returns the instruction set extensions used by the code in mem. Since
+// data cannot be told apart from code, the result may include extensions that
+// are not actually used.
+func isa(mem []vm.Cell) (isa vm.ISA) {
+	for pc := 0; pc < len(mem); pc++ {
+		switch op := mem[pc]; op {
+		case vm.OpCall:
+			isa |= vm.ISACall
+			pc++
+		case vm.OpFAdd, vm.OpFSub, vm.OpFMul, vm.OpFDiv, vm.OpFtoi, vm.OpItof:
+			isa |= vm.ISAFloat
+		case vm.OpFGtJump, vm.OpFLtJump, vm.OpFNeJump, vm.OpFEqJump:
+			isa |= vm.ISAFloat
+			pc++
+		case vm.OpLit, vm.OpLoop, vm.OpJump, vm.OpGtJump, vm.OpLtJump, vm.OpNeJump, vm.OpEqJump:
+			pc++
+		}
+	}
+	return isa
+}
+
+// writeFile creates the named file and writes to it with fn.
+func writeFile(name string, fn func(w io.Writer) error) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err = fn(w); err == nil {
+		err = w.Flush()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// writeListing writes a listing of prog assembled from src to w.
+func writeListing(w io.Writer, prog *asm.Program, src []byte) error {
+	ranges := make(map[int][]asm.SourceRange)
+	for _, r := range prog.Lines {
+		ranges[r.Line] = append(ranges[r.Line], r)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(src), "\n"), "\n")
+	for n, text := range lines {
+		var cells [][]vm.Cell
+		var addrs []int
+		for _, r := range ranges[n+1] {
+			for k := 0; k < r.Count; k += listCells {
+				end := k + listCells
+				if end > r.Count {
+					end = r.Count
+				}
+				addrs = append(addrs, r.Addr+k)
+				cells = append(cells, prog.Image[r.Addr+k:r.Addr+end])
+			}
+		}
+		if len(cells) == 0 {
+			if err := listLine(w, "", "", text); err != nil {
+				return err
+			}
+			continue
+		}
+		for k, c := range cells {
+			var b []byte
+			for _, v := range c {
+				b = strconv.AppendInt(append(b, ' '), int64(v), 10)
+			}
+			if err := listLine(w, strconv.Itoa(addrs[k]), string(b[1:]), text); err != nil {
+				return err
+			}
+			text = ""
+		}
+	}
+	return nil
+}
+
+// listLine writes a single listing line without trailing white space.
+func listLine(w io.Writer, addr, cells, text string) error {
+	l := fmt.Sprintf("%8s  %-44s  %s", addr, cells, text)
+	_, err := io.WriteString(w, strings.TrimRight(l, " ")+"\n")
+	return err
+}
+
+// writeMap writes the symbol map of prog to w.
+func writeMap(w io.Writer, prog *asm.Program) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+	for _, s := range prog.Symbols {
+		if _, err := fmt.Fprintf(tw, "%v\t%s\t%d\t%s\n", s.Kind, s.Name, s.Value, s.Pos); err != nil {
+			return err
+		}
+	}
+	return tw.Flush()
+}
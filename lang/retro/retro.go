@@ -0,0 +1,123 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package retro provides Retro specific behaviors for the ngaro VM: the Retro
+// string encoding, image shrinking on save, loading of stock Retro images and
+// a console setup suitable for the Retro listener.
+package retro
+
+import (
+	"io"
+
+	"github.com/dobegor/ngaro/vm"
+)
+
+const (
+	// DefaultSize is the memory size, in cells, of a Retro VM. Retro uses the
+	// memory above the end of its image as heap and buffer space.
+	DefaultSize = 1000000
+
+	// CellBits is the number of bits per cell in stock Retro image files.
+	CellBits = 32
+
+	// heapAddr is the address of the cell holding the top of the heap in
+	// Retro images.
+	heapAddr = 3
+)
+
+// StringCodec is the Retro string encoding: one byte per cell, followed by a 0
+// cell.
+var StringCodec = vm.ByteCodec
+
+// ShrinkImage returns the part of mem that needs to be saved: Retro keeps the
+// address of the top of its heap in cell 3, and everything above it is free
+// space. If cell 3 does not hold a valid address, mem is returned unchanged.
+func ShrinkImage(mem []vm.Cell) []vm.Cell {
+	if len(mem) > heapAddr {
+		if end := mem[heapAddr]; end > heapAddr && end <= vm.Cell(len(mem)) {
+			return mem[:end]
+		}
+	}
+	return mem
+}
+
+// SaveMemImage saves the shrunk memory image mem to fileName with 32 bits cells
+// (see ShrinkImage). It can be used with the vm.SaveMemImage option.
+func SaveMemImage(fileName string, mem []vm.Cell) error {
+	return vm.Save(fileName, ShrinkImage(mem), CellBits)
+}
+
+// Load loads the stock Retro image fileName, with 32 bits cells, into a memory
+// of DefaultSize cells, or more if the image is larger.
+func Load(fileName string) ([]vm.Cell, error) {
+	mem, _, err := vm.Load(fileName, DefaultSize, CellBits)
+	return mem, err
+}
+
+// New loads the Retro image fileName and returns a new VM instance configured
+// to run it: string operations use StringCodec and saving the image from Retro
+// writes the shrunk image back to fileName. Additional options are applied
+// after these settings.
+func New(fileName string, opts ...vm.Option) (*vm.Instance, error) {
+	mem, err := Load(fileName)
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]vm.Option{
+		vm.StringCodec(StringCodec),
+		vm.SaveMemImage(SaveMemImage),
+	}, opts...)
+	return vm.New(mem, fileName, opts...)
+}
+
+// Console connects the Retro listener to in and out. If out has a Flush method,
+// like a bufio.Writer, it is flushed whenever Retro requests a screen update or
+// waits for input, so that prompts are displayed before the listener blocks.
+// The caller must flush it after the VM exits. The size function reports the
+// console size to Retro; it may be nil.
+//
+// For interactive use, the terminal should not echo input and should deliver
+// keys as they are typed, since the listener echoes its input itself.
+func Console(in io.Reader, out io.Writer, size func() (width, height int)) vm.Option {
+	return func(i *vm.Instance) error {
+		var flush func() error
+		if f, ok := out.(flusher); ok {
+			flush = f.Flush
+		}
+		return i.SetOptions(
+			vm.Input(&flushReader{r: in, flush: flush}),
+			vm.Output(vm.NewVT100Terminal(out, flush, size)))
+	}
+}
+
+type flusher interface {
+	Flush() error
+}
+
+// flushReader calls flush, if not nil, before reading from r.
+type flushReader struct {
+	r     io.Reader
+	flush func() error
+}
+
+func (f *flushReader) Read(b []byte) (int, error) {
+	if f.flush != nil {
+		if err := f.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return f.r.Read(b)
+}
@@ -0,0 +1,116 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retro_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dobegor/ngaro/lang/retro"
+	"github.com/dobegor/ngaro/vm"
+)
+
+// testImage copies the test image to a temporary directory and returns its
+// path. The image is assembled from vm/testdata/retro.nga. It is not a stock
+// Retro image: it only has the Retro memory layout, so these tests check the
+// image handling (loading, memory size, shrinking on save) and the console
+// plumbing, not the behavior of the Retro listener: booting, evaluating input
+// and saving have not been tested against a real Retro image.
+func testImage(t *testing.T) string {
+	b, err := os.ReadFile("../../vm/testdata/retro.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "retroImage")
+	if err = os.WriteFile(name, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestNew(t *testing.T) {
+	name := testImage(t)
+	var out bytes.Buffer
+	w := bufio.NewWriter(&out)
+	i, err := retro.New(name, retro.Console(strings.NewReader("hello!"), w, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(i.Mem) != retro.DefaultSize {
+		t.Errorf("expected memory size %d, got %d", retro.DefaultSize, len(i.Mem))
+	}
+	if err = i.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// output is flushed before each read
+	if s := out.String(); s != "Retro test image\nHELLO" {
+		t.Errorf("unexpected output %q", s)
+	}
+
+	// the image saved by the guest is shrunk to the top of the heap
+	mem, err := retro.Load(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := int(mem[3])
+	if st.Size() != int64(end)*retro.CellBits/8 {
+		t.Errorf("expected image size %d, got %d", end*retro.CellBits/8, st.Size())
+	}
+	if s := string(retro.StringCodec.Decode(mem[:end], vm.Cell(end-5))); s != "hello" {
+		t.Errorf("expected heap contents %q, got %q", "hello", s)
+	}
+}
+
+func TestShrinkImage(t *testing.T) {
+	for _, tc := range []struct {
+		mem []vm.Cell
+		n   int
+	}{
+		{[]vm.Cell{8, 0, 0, 5, 1, 2, 3, 4}, 5},
+		{[]vm.Cell{8, 0, 0, 8, 1, 2, 3, 4}, 8},
+		{[]vm.Cell{8, 0, 0, 9, 1, 2, 3, 4}, 8},
+		{[]vm.Cell{8, 0, 0, -1, 1, 2, 3, 4}, 8},
+		{[]vm.Cell{8, 0, 0}, 3},
+	} {
+		if n := len(retro.ShrinkImage(tc.mem)); n != tc.n {
+			t.Errorf("%v: expected %d cells, got %d", tc.mem, tc.n, n)
+		}
+	}
+}
+
+func ExampleConsole() {
+	img := []vm.Cell{vm.OpLit, 'A', vm.OpLit, 1, vm.OpLit, 2, vm.OpOut, vm.OpWait}
+	i, err := vm.New(img, "", retro.Console(strings.NewReader(""), os.Stdout, nil))
+	if err != nil {
+		panic(err)
+	}
+	if err = i.Run(); err != nil {
+		panic(err)
+	}
+	fmt.Println()
+	// Output:
+	// A
+}
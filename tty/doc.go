@@ -0,0 +1,25 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tty provides raw mode terminal input for ngaro VMs.
+//
+// A TTY puts a terminal into raw mode, decodes the keys typed by the user,
+// including arrows, function keys and modifiers, and feeds them to the
+// keyboard device of a VM instance (see vm.Keyboard). It also implements
+// io.Writer so that it can be used as the output of the VM.
+//
+// Raw mode is only supported on POSIX systems.
+package tty
@@ -0,0 +1,145 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tty
+
+import (
+	"unicode/utf8"
+
+	"github.com/dobegor/ngaro/vm"
+)
+
+const esc = 0x1b
+
+// Keys for the final byte of ESC [ and ESC O sequences.
+var csiKeys = map[byte]vm.Cell{
+	'A': vm.KeyUp,
+	'B': vm.KeyDown,
+	'C': vm.KeyRight,
+	'D': vm.KeyLeft,
+	'H': vm.KeyHome,
+	'F': vm.KeyEnd,
+	'P': vm.KeyF1,
+	'Q': vm.KeyF2,
+	'R': vm.KeyF3,
+	'S': vm.KeyF4,
+}
+
+// Keys for ESC [ n ~ sequences, indexed by n.
+var tildeKeys = map[int]vm.Cell{
+	1:  vm.KeyHome,
+	2:  vm.KeyInsert,
+	3:  vm.KeyDelete,
+	4:  vm.KeyEnd,
+	5:  vm.KeyPageUp,
+	6:  vm.KeyPageDown,
+	7:  vm.KeyHome,
+	8:  vm.KeyEnd,
+	11: vm.KeyF1,
+	12: vm.KeyF2,
+	13: vm.KeyF3,
+	14: vm.KeyF4,
+	15: vm.KeyF5,
+	17: vm.KeyF6,
+	18: vm.KeyF7,
+	19: vm.KeyF8,
+	20: vm.KeyF9,
+	21: vm.KeyF10,
+	23: vm.KeyF11,
+	24: vm.KeyF12,
+}
+
+// ParseKey decodes the first key in b, as sent by a terminal in raw mode, and
+// returns the key code and modifiers as expected by vm.Instance.KeyEvent,
+// together with the number of bytes consumed. Unknown escape sequences are
+// consumed and reported as key 0. A lone ESC at the end of b is reported as the
+// Escape key, so b should contain all the bytes read at once from the
+// terminal.
+func ParseKey(b []byte) (key, mods vm.Cell, n int) {
+	if len(b) == 0 {
+		return 0, 0, 0
+	}
+	switch c := b[0]; {
+	case c == esc:
+		if len(b) == 1 {
+			return esc, 0, 1
+		}
+		switch b[1] {
+		case '[':
+			if key, mods, n, ok := parseCSI(b[2:]); ok {
+				return key, mods, n + 2
+			}
+		case 'O':
+			if len(b) > 2 {
+				return csiKeys[b[2]], 0, 3
+			}
+		}
+		key, mods, n = ParseKey(b[1:])
+		return key, mods | vm.ModAlt, n + 1
+	case c == '\r' || c == '\t':
+		return vm.Cell(c), 0, 1
+	case c == '\b' || c == 0x7f:
+		return 0x7f, 0, 1
+	case c == 0:
+		return ' ', vm.ModCtrl, 1
+	case c < 0x1b:
+		return vm.Cell('a' + c - 1), vm.ModCtrl, 1
+	case c < ' ':
+		return vm.Cell(c + 0x40), vm.ModCtrl, 1
+	}
+	r, n := utf8.DecodeRune(b)
+	if r == utf8.RuneError && n == 1 {
+		return vm.Cell(b[0]), 0, 1
+	}
+	return vm.Cell(r), 0, n
+}
+
+// parseCSI parses the parameters and final byte of an ESC [ sequence.
+func parseCSI(b []byte) (key, mods vm.Cell, n int, ok bool) {
+	if len(b) > 1 && b[0] == '[' && b[1] >= 'A' && b[1] <= 'E' {
+		// Linux console F1 to F5
+		return vm.KeyF1 - vm.Cell(b[1]-'A'), 0, 2, true
+	}
+	var p [2]int
+	np := 0
+	for ; n < len(b); n++ {
+		c := b[n]
+		switch {
+		case c >= '0' && c <= '9':
+			if np < len(p) {
+				p[np] = p[np]*10 + int(c-'0')
+			}
+		case c == ';':
+			np++
+		case c >= 0x40 && c <= 0x7e:
+			if p[1] > 1 {
+				mods = vm.Cell(p[1]-1) & (vm.ModShift | vm.ModAlt | vm.ModCtrl)
+			}
+			switch c {
+			case '~':
+				key = tildeKeys[p[0]]
+			case 'Z':
+				key, mods = '\t', mods|vm.ModShift
+			default:
+				key = csiKeys[c]
+			}
+			return key, mods, n + 1, true
+		default:
+			return 0, 0, 0, false
+		}
+	}
+	return 0, 0, 0, false
+}
@@ -0,0 +1,59 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tty_test
+
+import (
+	"testing"
+
+	"github.com/dobegor/ngaro/tty"
+	"github.com/dobegor/ngaro/vm"
+)
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		in   string
+		key  vm.Cell
+		mods vm.Cell
+		n    int
+	}{
+		{"a", 'a', 0, 1},
+		{"é", 'é', 0, 2},
+		{"\r", '\r', 0, 1},
+		{"\x7f", 0x7f, 0, 1},
+		{"\x01", 'a', vm.ModCtrl, 1},
+		{"\x1b", 0x1b, 0, 1},
+		{"\x1bx", 'x', vm.ModAlt, 2},
+		{"\x1b[A", vm.KeyUp, 0, 3},
+		{"\x1bOD", vm.KeyLeft, 0, 3},
+		{"\x1bOP", vm.KeyF1, 0, 3},
+		{"\x1b[1;5C", vm.KeyRight, vm.ModCtrl, 6},
+		{"\x1b[1;2H", vm.KeyHome, vm.ModShift, 6},
+		{"\x1b[3~", vm.KeyDelete, 0, 4},
+		{"\x1b[6;3~", vm.KeyPageDown, vm.ModAlt, 6},
+		{"\x1b[24~", vm.KeyF12, 0, 5},
+		{"\x1b[[B", vm.KeyF2, 0, 4},
+		{"\x1b[Z", '\t', vm.ModShift, 3},
+		{"\x1b[99~", 0, 0, 5},
+		{"\x1b[Ab", vm.KeyUp, 0, 3},
+	}
+	for _, tt := range tests {
+		key, mods, n := tty.ParseKey([]byte(tt.in))
+		if key != tt.key || mods != tt.mods || n != tt.n {
+			t.Errorf("%q: expected %d %d %d, got %d %d %d", tt.in, tt.key, tt.mods, tt.n, key, mods, n)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package tty
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dobegor/ngaro/vm"
+	"github.com/pkg/errors"
+	"github.com/pkg/term"
+)
+
+// Time after which a pending read of the terminal returns so that the reader
+// can check if it should stop.
+const readTimeout = 100 * time.Millisecond
+
+// TTY is a terminal in raw mode.
+type TTY struct {
+	t    *term.Term
+	once sync.Once
+	mu   sync.Mutex     // protects done against concurrent Run and Restore
+	wg   sync.WaitGroup // key reader
+	done chan struct{}
+	err  error
+}
+
+// Open opens the named terminal device, usually "/dev/tty", and puts it into
+// raw mode. The terminal must be restored to its original state by calling
+// Restore or by running a VM with Run.
+func Open(name string) (*TTY, error) {
+	t, err := term.Open(name, term.RawMode, term.ReadTimeout(readTimeout))
+	if err != nil {
+		return nil, errors.Wrap(err, "open terminal")
+	}
+	return &TTY{t: t, done: make(chan struct{})}, nil
+}
+
+// Write writes b to the terminal. Since output processing is disabled in raw
+// mode, newlines are translated to CR LF pairs.
+func (t *TTY) Write(b []byte) (int, error) {
+	if _, err := t.t.Write(bytes.Replace(b, []byte{'\n'}, []byte{'\r', '\n'}, -1)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Restore restores the terminal to the state it was in when opened and closes
+// it. It is safe to call Restore more than once and from multiple goroutines.
+// If a VM is running, Restore waits for the key reader to stop, which takes at
+// most 100ms.
+func (t *TTY) Restore() error {
+	t.once.Do(func() {
+		t.mu.Lock()
+		close(t.done)
+		t.mu.Unlock()
+		t.wg.Wait()
+		t.err = t.t.Restore()
+		if err := t.t.Close(); t.err == nil {
+			t.err = err
+		}
+	})
+	return t.err
+}
+
+// Run feeds the keys typed on the terminal to the keyboard device of i and runs
+// the VM until it exits, fails or is stopped with i.Stop. The terminal is
+// restored when Run returns, including when the VM panics. The terminal is
+// also restored if the process receives an interrupt or termination signal
+// while the VM is running, in which case the signal is then delivered again
+// with the default behavior.
+func (t *TTY) Run(i *vm.Instance) error {
+	defer t.Restore()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case s := <-sig:
+			t.Restore()
+			signal.Reset(s)
+			if p, err := os.FindProcess(os.Getpid()); err == nil {
+				p.Signal(s)
+			}
+		case <-t.done:
+		}
+	}()
+
+	t.mu.Lock()
+	select {
+	case <-t.done:
+		t.mu.Unlock()
+		return errors.New("terminal already restored")
+	default:
+	}
+	t.wg.Add(1)
+	t.mu.Unlock()
+	go t.readKeys(i)
+	return i.Run()
+}
+
+// readKeys reads keys from the terminal until it is restored.
+func (t *TTY) readKeys(i *vm.Instance) {
+	defer t.wg.Done()
+	var buf [256]byte
+	for {
+		n, err := t.t.Read(buf[:])
+		select {
+		case <-t.done:
+			return
+		default:
+		}
+		if err != nil && err != io.EOF {
+			return
+		}
+		for b := buf[:n]; len(b) > 0; {
+			key, mods, n := ParseKey(b)
+			if key != 0 {
+				i.KeyEvent(key, mods)
+			}
+			b = b[n:]
+		}
+	}
+}
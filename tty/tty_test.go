@@ -0,0 +1,73 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package tty_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/dobegor/ngaro/tty"
+	"github.com/dobegor/ngaro/vm"
+	"github.com/pkg/term/termios"
+)
+
+func TestTTY(t *testing.T) {
+	m, s, err := termios.Pty()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer m.Close()
+	defer s.Close()
+	tt, err := tty.Open(s.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// read one key from the keyboard device on port 14
+	i, err := vm.New([]vm.Cell{
+		vm.OpLit, 2, vm.OpLit, 14, vm.OpOut,
+		vm.OpLit, 0, vm.OpLit, 0, vm.OpOut,
+		vm.OpWait, vm.OpLit, 14, vm.OpIn,
+	}, "", vm.Keyboard(14))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.Write([]byte("\x1b[1;3B")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tt.Write([]byte("ok\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err = tt.Run(i); err != nil {
+		t.Fatal(err)
+	}
+	if s, exp := fmt.Sprint(i.Data()), fmt.Sprintf("[%d %d]", vm.KeyDown, vm.ModAlt); s != exp {
+		t.Errorf("expected %s, got %s", exp, s)
+	}
+	b := make([]byte, 16)
+	n, err := m.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(b[:n]); s != "ok\r\n" {
+		t.Errorf("expected %q, got %q", "ok\r\n", s)
+	}
+	if err = tt.Restore(); err != nil {
+		t.Errorf("second Restore: %v", err)
+	}
+}
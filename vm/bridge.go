@@ -0,0 +1,348 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	cellType     = reflect.TypeOf(Cell(0))
+	cellsType    = reflect.TypeOf([]Cell(nil))
+	errorType    = reflect.TypeOf((*error)(nil)).Elem()
+	instanceType = reflect.TypeOf((*Instance)(nil))
+)
+
+// Bind exposes the Go function fn to guest programs under the given name.
+// Functions are numbered in the order they are bound, starting at 1. Guests
+// call them through a bridge device bound to the given WAIT port. The suggested
+// port is 16. All functions of an instance must be bound to the same port. The
+// bridge device supports the following requests (stack effects in
+// parentheses):
+//
+//	1  lookup ( name -- n )
+//	2  call   ( args... dsts... n -- results... f )
+//
+// Lookup returns the number of the function with the given name, encoded with
+// the configured Codec, or 0 if there is no such function. Call calls function
+// n and returns -1 on success, 0 on failure.
+//
+// Arguments and results are marshaled according to their Go type:
+//
+//	integer types     1 cell
+//	float types       1 cell, the bits of an FCell
+//	bool              1 cell, -1 for true, 0 for false
+//	string            address of the string, encoded with the Codec
+//	[]Cell            address and number of cells
+//
+// Arguments are taken from the stack in order, the first one being the
+// deepest. The function may have a first argument of type *Instance, in which
+// case it receives the calling instance; it does not take any cell. For string
+// and []Cell results, the guest must provide destinations after the arguments:
+// an address for strings, an address and a maximum number of cells for []Cell
+// results. String results are stored at their destination and are not pushed.
+// []Cell results are copied to their destination, truncated if needed, and
+// pushed as the total number of cells in the result. Results are pushed in
+// order, followed by the success flag.
+//
+// If the last result of fn is an error, it is not pushed. Instead, a non-nil
+// error makes the call fail and sets the error code returned by port 4 request
+// -11 (see Errno). Errors of type Errno are passed as is. On failure, and if n is
+// not a valid function number, all results are 0. If n is not valid, nothing is
+// taken from the stack.
+//
+// Bind returns an error if fn is not a function, if its arguments or results
+// are of an unsupported type, or if other functions are bound to a different
+// port.
+func Bind(port Cell, name string, fn interface{}) Option {
+	return func(i *Instance) error {
+		f, err := newHostFunc(name, fn)
+		if err != nil {
+			return err
+		}
+		if i.bridge == nil {
+			i.bridge = &bridge{port: port, names: make(map[string]Cell)}
+			// look the bridge up at call time so that clones use their own
+			i.bindWaitHandler(port, func(i *Instance, v, port Cell) error {
+				return i.bridge.wait(i, v, port)
+			})
+		} else if i.bridge.port != port {
+			return errors.Errorf("Bind %s: functions are bound to port %d", name, i.bridge.port)
+		}
+		b := i.bridge
+		b.funcs = append(b.funcs, f)
+		b.names[name] = Cell(len(b.funcs))
+		return nil
+	}
+}
+
+type bridge struct {
+	port  Cell
+	funcs []*hostFunc
+	names map[string]Cell
+}
+
+// clone returns a copy of b that functions can be bound to without affecting b.
+func (b *bridge) clone() *bridge {
+	if b == nil {
+		return nil
+	}
+	c := &bridge{
+		port:  b.port,
+		funcs: append([]*hostFunc(nil), b.funcs...),
+		names: make(map[string]Cell, len(b.names)),
+	}
+	for n, f := range b.names {
+		c.names[n] = f
+	}
+	return c
+}
+
+// hostFunc is a Go function callable by guests.
+type hostFunc struct {
+	fn    reflect.Value
+	inst  bool // the first argument is the calling *Instance
+	in    []reflect.Type
+	out   []reflect.Type
+	err   bool // the last result is an error
+	cells int  // number of cells taken from the stack
+}
+
+func supported(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Bool, reflect.String:
+		return true
+	}
+	return t == cellsType
+}
+
+func newHostFunc(name string, fn interface{}) (*hostFunc, error) {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	if v.Kind() != reflect.Func || t.IsVariadic() {
+		return nil, errors.Errorf("bind %s: %v is not a supported function type", name, t)
+	}
+	f := &hostFunc{fn: v}
+	for k := 0; k < t.NumIn(); k++ {
+		a := t.In(k)
+		switch {
+		case k == 0 && a == instanceType:
+			f.inst = true
+			continue
+		case !supported(a):
+			return nil, errors.Errorf("bind %s: unsupported argument type %v", name, a)
+		case a == cellsType:
+			f.cells++
+		}
+		f.in = append(f.in, a)
+		f.cells++
+	}
+	for k := 0; k < t.NumOut(); k++ {
+		r := t.Out(k)
+		switch {
+		case k == t.NumOut()-1 && r == errorType:
+			f.err = true
+			continue
+		case !supported(r):
+			return nil, errors.Errorf("bind %s: unsupported result type %v", name, r)
+		case r == cellsType:
+			f.cells += 2
+		case r.Kind() == reflect.String:
+			f.cells++
+		}
+		f.out = append(f.out, r)
+	}
+	return f, nil
+}
+
+func fromCell(t reflect.Type, c Cell) reflect.Value {
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(int64(c))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		v.SetUint(uint64(c))
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(float64(*c.AsFCell()))
+	case reflect.Bool:
+		v.SetBool(c != 0)
+	}
+	return v
+}
+
+func toCell(v reflect.Value) Cell {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return Cell(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return Cell(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		f := FCell(v.Float())
+		return *f.AsCell()
+	case reflect.Bool:
+		if v.Bool() {
+			return -1
+		}
+	}
+	return 0
+}
+
+func (b *bridge) wait(i *Instance, v, port Cell) error {
+	i.errno = ErrnoOK
+	var r Cell
+	switch v {
+	case 1: // lookup
+		name := i.Pop()
+		if i.sEnc == nil {
+			i.errno = ErrnoInvalid
+			break
+		}
+		r = b.names[string(i.sEnc.Decode(i.Mem, name))]
+	case 2: // call
+		n := i.Pop()
+		if n < 1 || n > Cell(len(b.funcs)) {
+			i.errno = ErrnoInvalid
+			break
+		}
+		r = b.call(i, b.funcs[n-1])
+	default:
+		i.errno = ErrnoInvalid
+	}
+	i.WaitReply(r, port)
+	return nil
+}
+
+// call calls f with arguments from the stack of i, pushes its results and
+// returns the success flag.
+func (b *bridge) call(i *Instance, f *hostFunc) Cell {
+	args := make([]Cell, f.cells)
+	for k := len(args) - 1; k >= 0; k-- {
+		args[k] = i.Pop()
+	}
+	next := func() Cell {
+		c := args[0]
+		args = args[1:]
+		return c
+	}
+
+	ok := true
+	var in []reflect.Value
+	if f.inst {
+		in = append(in, reflect.ValueOf(i))
+	}
+	for _, t := range f.in {
+		switch {
+		case t == cellsType:
+			addr, count := next(), next()
+			if !i.inMem(addr, count) {
+				ok = false
+				break
+			}
+			in = append(in, reflect.ValueOf(append([]Cell(nil), i.Mem[addr:addr+count]...)))
+		case t.Kind() == reflect.String:
+			s := next()
+			if i.sEnc == nil {
+				ok = false
+				break
+			}
+			in = append(in, reflect.ValueOf(string(i.sEnc.Decode(i.Mem, s))).Convert(t))
+		default:
+			in = append(in, fromCell(t, next()))
+		}
+	}
+	dsts := args
+	for _, t := range f.out {
+		ok = ok && (t.Kind() != reflect.String || i.sEnc != nil)
+	}
+	if !ok {
+		i.errno = ErrnoInvalid
+	}
+
+	// Results are recorded as one cell per scalar, and length followed by
+	// contents for strings and slices.
+	_, data := i.devCall(func() (Cell, []Cell) {
+		if !ok {
+			return 0, nil
+		}
+		out := f.fn.Call(in)
+		if f.err {
+			if err, _ := out[len(out)-1].Interface().(error); err != nil {
+				i.setErrno(err)
+				return 0, nil
+			}
+			out = out[:len(out)-1]
+		}
+		var data []Cell
+		for _, v := range out {
+			switch {
+			case v.Type() == cellsType:
+				c := v.Interface().([]Cell)
+				data = append(append(data, Cell(len(c))), c...)
+			case v.Kind() == reflect.String:
+				s := v.String()
+				data = append(data, Cell(len(s)))
+				data = append(data, bytesToCells([]byte(s))...)
+			default:
+				data = append(data, toCell(v))
+			}
+		}
+		return 0, data
+	})
+
+	ok = i.errno == ErrnoOK
+	for _, t := range f.out {
+		switch {
+		case !ok:
+			if t.Kind() != reflect.String {
+				i.Push(0)
+			}
+		case t == cellsType, t.Kind() == reflect.String:
+			n := data[0]
+			v := data[1 : 1+n]
+			data = data[1+n:]
+			i.UnshareMem()
+			if t == cellsType {
+				addr, max := dsts[0], dsts[1]
+				dsts = dsts[2:]
+				if !i.inMem(addr, max) {
+					i.errno = ErrnoInvalid
+					i.Push(0)
+					continue
+				}
+				if n > max {
+					v = v[:max]
+				}
+				copy(i.Mem[addr:], v)
+				i.Push(n)
+			} else {
+				i.sEnc.Encode(i.Mem, dsts[0], cellsToBytes(v))
+				dsts = dsts[1:]
+			}
+		default:
+			i.Push(data[0])
+			data = data[1:]
+		}
+	}
+	if i.errno == ErrnoOK {
+		return -1
+	}
+	return 0
+}
@@ -0,0 +1,138 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm_test
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/dobegor/ngaro/asm"
+	"github.com/dobegor/ngaro/vm"
+)
+
+func TestBind(t *testing.T) {
+	var caller *vm.Instance
+	i, err := runAsmImage(`jump start
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:call 2 16 call io ;
+		:n .dat "upper"
+		:s .dat "hello"
+		:v .dat 1
+		   .dat 2
+		   .dat 3
+		.org 96
+		:str .dat 0
+		.org 112
+		:rev .dat 0
+		.org 128
+		:start
+			lit n 1 16 call io
+			40 2 1 call call
+			3.0 4.0 2 call call
+			lit s lit str 3 call call
+			lit v 3 4 call call
+			lit v 0 4 call call -11 4 call io
+			lit v 3 lit rev 2 5 call call
+			6 call call
+			99 call call -11 4 call io
+		`, "Bind", vm.StringCodec(testCodec{}),
+		vm.Bind(16, "add", func(a, b vm.Cell) vm.Cell { return a + b }),
+		vm.Bind(16, "hypot", math.Hypot),
+		vm.Bind(16, "upper", strings.ToUpper),
+		vm.Bind(16, "sum", func(v []vm.Cell) (vm.Cell, error) {
+			if len(v) == 0 {
+				return 0, vm.ErrnoInvalid
+			}
+			var s vm.Cell
+			for _, c := range v {
+				s += c
+			}
+			return s, nil
+		}),
+		vm.Bind(16, "reverse", func(v []vm.Cell) []vm.Cell {
+			for k, l := 0, len(v)-1; k < l; k, l = k+1, l-1 {
+				v[k], v[l] = v[l], v[k]
+			}
+			return v
+		}),
+		vm.Bind(16, "self", func(i *vm.Instance) bool { caller = i; return true }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := i.Data()
+	f := vm.FCell(5)
+	assertEqual(t, "Bind", fmt.Sprintf("[3 42 -1 %d -1 -1 6 -1 0 0 %d 3 -1 -1 -1 0 %d]", *f.AsCell(), vm.ErrnoInvalid, vm.ErrnoInvalid), fmt.Sprint(d))
+	assertEqual(t, "Bind string", "HELLO", string(testCodec{}.Decode(i.Mem, 96)))
+	assertEqual(t, "Bind slice", "[3 2 0]", fmt.Sprint(i.Mem[112:115]))
+	if caller != i {
+		t.Error("Bind: *Instance argument is not the caller")
+	}
+
+	_, err = vm.New(nil, "", vm.Bind(16, "bad", func(map[string]int) {}))
+	if err == nil {
+		t.Error("Bind: expected error for unsupported argument type")
+	}
+	_, err = vm.New(nil, "", vm.Bind(16, "bad", 42))
+	if err == nil {
+		t.Error("Bind: expected error for non function")
+	}
+	nop := func() {}
+	_, err = vm.New(nil, "", vm.Bind(16, "f", nop), vm.Bind(17, "g", nop))
+	if err == nil {
+		t.Error("Bind: expected error for functions on different ports")
+	}
+}
+
+func TestBind_clone(t *testing.T) {
+	// look up "f" and "g", leaving their numbers on the stack
+	img, err := asm.Assemble("Bind_clone", strings.NewReader(`jump start
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:f .dat "f"
+		:g .dat "g"
+		:start
+			lit f 1 16 call io
+			lit g 1 16 call io
+		`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := vm.New(img, "Bind_clone", vm.StringCodec(testCodec{}),
+		vm.Bind(16, "f", func() vm.Cell { return 1 }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := i.Clone()
+	if err = c.SetOptions(vm.Bind(16, "g", func() vm.Cell { return 2 })); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err = i.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if s := fmt.Sprint(c.Data()); s != "[1 2]" {
+		t.Errorf("clone: expected [1 2], got %s", s)
+	}
+	if s := fmt.Sprint(i.Data()); s != "[1 0]" {
+		t.Errorf("original: expected [1 0], got %s", s)
+	}
+}
@@ -0,0 +1,293 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/big"
+)
+
+// CanvasPalette is the palette used by the canvas device for colors 0 to 15.
+var CanvasPalette = [16]color.RGBA{
+	{0x00, 0x00, 0x00, 0xff}, // black
+	{0x00, 0x00, 0x80, 0xff}, // dark blue
+	{0x00, 0x80, 0x00, 0xff}, // dark green
+	{0x00, 0x80, 0x80, 0xff}, // dark cyan
+	{0x80, 0x00, 0x00, 0xff}, // dark red
+	{0x80, 0x00, 0x80, 0xff}, // purple
+	{0x80, 0x80, 0x00, 0xff}, // brown
+	{0xc0, 0xc0, 0xc0, 0xff}, // gray
+	{0x80, 0x80, 0x80, 0xff}, // dark gray
+	{0x00, 0x00, 0xff, 0xff}, // blue
+	{0x00, 0xff, 0x00, 0xff}, // green
+	{0x00, 0xff, 0xff, 0xff}, // cyan
+	{0xff, 0x00, 0x00, 0xff}, // red
+	{0xff, 0x00, 0xff, 0xff}, // magenta
+	{0xff, 0xff, 0x00, 0xff}, // yellow
+	{0xff, 0xff, 0xff, 0xff}, // white
+}
+
+// Canvas binds the canvas device to port 6 and renders all drawing operations
+// into img. It also enables the canvas related capability queries on port 5:
+// -2 returns -1 (canvas present), -3 and -4 return the canvas width and
+// height.
+//
+// The following requests are supported on port 6 (stack effects in
+// parentheses):
+//
+//	1   color         ( n -- )
+//	2   pixel         ( x y -- )
+//	3   rectangle     ( x y h w -- )
+//	4   filled rect   ( x y h w -- )
+//	5   vertical line ( x y h -- )
+//	6   horiz. line   ( x y w -- )
+//	7   circle        ( x y r -- )
+//	8   filled circle ( x y r -- )
+//	9   line          ( x1 y1 x2 y2 -- )
+//	10  clear         ( -- )
+//
+// Requests 1 to 8 are defined by the Ngaro specification, 9 and 10 are
+// extensions. Colors 0 to 15 are taken from CanvasPalette. Other colors are
+// interpreted as 0xRRGGBB values. The initial color is 0. Coordinates are
+// relative to the top left corner of img and drawing is clipped to its bounds.
+// Circle radii larger than the canvas diagonal are reduced to it. Clear fills
+// the whole canvas with the current color.
+//
+// The VM draws into img without any locking. The host must not access img
+// while the VM is running, except from a ticker function (see Ticker). Clones
+// of the instance draw into the same img and must not run concurrently (see
+// Clone).
+func Canvas(img *image.RGBA) Option {
+	return func(i *Instance) error {
+		c := &canvas{img: img, c: CanvasPalette[0]}
+		i.bindWaitHandler(6, c.wait)
+		i.setDevCap(-2, -1)
+		i.setDevCap(-3, Cell(img.Rect.Dx()))
+		i.setDevCap(-4, Cell(img.Rect.Dy()))
+		return nil
+	}
+}
+
+// setDevCap sets the value returned by the port 5 capability query q.
+func (i *Instance) setDevCap(q, v Cell) {
+	if i.devCaps == nil {
+		i.devCaps = make(map[Cell]Cell)
+	}
+	i.devCaps[q] = v
+}
+
+type canvas struct {
+	img *image.RGBA
+	c   color.RGBA
+}
+
+func (c *canvas) set(x, y int) {
+	p := c.img.Rect.Min
+	x, y = x+p.X, y+p.Y
+	if (image.Point{x, y}).In(c.img.Rect) {
+		c.img.SetRGBA(x, y, c.c)
+	}
+}
+
+func (c *canvas) fill(x, y, w, h int) {
+	r := image.Rect(x, y, x+w, y+h).Add(c.img.Rect.Min).Intersect(c.img.Rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c.img.SetRGBA(x, y, c.c)
+		}
+	}
+}
+
+// clip clips the segment (x0, y0)-(x1, y1) to the canvas with the
+// Liang-Barsky algorithm. It returns false if the segment lies outside the
+// canvas. Segments that are inside are returned unchanged. Since guest
+// coordinates may span the whole Cell range, clipping uses exact arithmetic.
+func (c *canvas) clip(x0, y0, x1, y1 int) (int, int, int, int, bool) {
+	w, h := c.img.Rect.Dx()-1, c.img.Rect.Dy()-1
+	in := func(x, y int) bool { return x >= 0 && x <= w && y >= 0 && y <= h }
+	if in(x0, y0) && in(x1, y1) {
+		return x0, y0, x1, y1, true
+	}
+	bi := func(v int) *big.Int { return big.NewInt(int64(v)) }
+	sub := func(a, b *big.Int) *big.Int { return new(big.Int).Sub(a, b) }
+	bx0, by0 := bi(x0), bi(y0)
+	dx, dy := sub(bi(x1), bx0), sub(bi(y1), by0)
+	t0, t1 := new(big.Rat), big.NewRat(1, 1)
+	for _, e := range [4][2]*big.Int{
+		{new(big.Int).Neg(dx), bx0},
+		{dx, sub(bi(w), bx0)},
+		{new(big.Int).Neg(dy), by0},
+		{dy, sub(bi(h), by0)},
+	} {
+		p, q := e[0], e[1]
+		if p.Sign() == 0 {
+			if q.Sign() < 0 {
+				return 0, 0, 0, 0, false
+			}
+			continue
+		}
+		t := new(big.Rat).SetFrac(q, p)
+		if p.Sign() < 0 {
+			if t.Cmp(t1) > 0 {
+				return 0, 0, 0, 0, false
+			}
+			if t.Cmp(t0) > 0 {
+				t0 = t
+			}
+		} else {
+			if t.Cmp(t0) < 0 {
+				return 0, 0, 0, 0, false
+			}
+			if t.Cmp(t1) < 0 {
+				t1 = t
+			}
+		}
+	}
+	// point at t, rounded to the nearest pixel; it is inside the canvas
+	at := func(t *big.Rat, v, d *big.Int) int {
+		f, _ := new(big.Rat).Add(new(big.Rat).SetInt(v), new(big.Rat).Mul(t, new(big.Rat).SetInt(d))).Float64()
+		return int(math.Round(f))
+	}
+	x0, y0, x1, y1 = at(t0, bx0, dx), at(t0, by0, dy), at(t1, bx0, dx), at(t1, by0, dy)
+	return x0, y0, x1, y1, true
+}
+
+func (c *canvas) line(x0, y0, x1, y1 int) {
+	x0, y0, x1, y1, ok := c.clip(x0, y0, x1, y1)
+	if !ok {
+		return
+	}
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	err := dx + dy
+	for {
+		c.set(x0, y0)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * err
+		if e2 >= dy {
+			err += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			err += dx
+			y0 += sy
+		}
+	}
+}
+
+func (c *canvas) circle(x0, y0, r int, filled bool) {
+	if d := int(math.Hypot(float64(c.img.Rect.Dx()), float64(c.img.Rect.Dy()))) + 1; r > d {
+		r = d
+	}
+	x, y, err := r, 0, 1-r
+	for x >= y {
+		if filled {
+			c.fill(x0-x, y0+y, 2*x+1, 1)
+			c.fill(x0-x, y0-y, 2*x+1, 1)
+			c.fill(x0-y, y0+x, 2*y+1, 1)
+			c.fill(x0-y, y0-x, 2*y+1, 1)
+		} else {
+			c.set(x0+x, y0+y)
+			c.set(x0+y, y0+x)
+			c.set(x0-y, y0+x)
+			c.set(x0-x, y0+y)
+			c.set(x0-x, y0-y)
+			c.set(x0-y, y0-x)
+			c.set(x0+y, y0-x)
+			c.set(x0+x, y0-y)
+		}
+		y++
+		if err < 0 {
+			err += 2*y + 1
+		} else {
+			x--
+			err += 2*(y-x) + 1
+		}
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// popArgs pops n values from the stack and returns them in push order.
+func popArgs(i *Instance, n int) []int {
+	a := make([]int, n)
+	for k := n - 1; k >= 0; k-- {
+		a[k] = int(i.Pop())
+	}
+	return a
+}
+
+func (c *canvas) wait(i *Instance, v, port Cell) error {
+	switch v {
+	case 1: // color
+		n := i.Pop()
+		if n >= 0 && n < 16 {
+			c.c = CanvasPalette[n]
+		} else {
+			c.c = color.RGBA{uint8(n >> 16), uint8(n >> 8), uint8(n), 0xff}
+		}
+	case 2: // pixel
+		a := popArgs(i, 2)
+		c.set(a[0], a[1])
+	case 3: // rectangle
+		a := popArgs(i, 4)
+		x, y, h, w := a[0], a[1], a[2], a[3]
+		if w > 0 && h > 0 {
+			c.fill(x, y, w, 1)
+			c.fill(x, y+h-1, w, 1)
+			c.fill(x, y, 1, h)
+			c.fill(x+w-1, y, 1, h)
+		}
+	case 4: // filled rectangle
+		a := popArgs(i, 4)
+		c.fill(a[0], a[1], a[3], a[2])
+	case 5: // vertical line
+		a := popArgs(i, 3)
+		c.fill(a[0], a[1], 1, a[2])
+	case 6: // horizontal line
+		a := popArgs(i, 3)
+		c.fill(a[0], a[1], a[2], 1)
+	case 7, 8: // circle, filled circle
+		a := popArgs(i, 3)
+		if a[2] >= 0 {
+			c.circle(a[0], a[1], a[2], v == 8)
+		}
+	case 9: // line
+		a := popArgs(i, 4)
+		c.line(a[0], a[1], a[2], a[3])
+	case 10: // clear
+		b := c.img.Rect
+		c.fill(0, 0, b.Dx(), b.Dy())
+	}
+	i.WaitReply(0, port)
+	return nil
+}
@@ -0,0 +1,110 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm_test
+
+import (
+	"fmt"
+	"image"
+	"strings"
+	"testing"
+
+	"github.com/dobegor/ngaro/vm"
+)
+
+// canvasString renders img as text: '.' for black pixels, '#' for others.
+func canvasString(img *image.RGBA) string {
+	var b strings.Builder
+	r := img.Bounds()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if c := img.RGBAAt(x, y); c.R|c.G|c.B == 0 {
+				b.WriteByte('.')
+			} else {
+				b.WriteByte('#')
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func TestCanvas(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 6))
+	draw := func(code string) *vm.Instance {
+		i, err := runAsmImage(`jump start
+			.org 32
+			:io dup push out 0 0 out wait pop in ;
+			:cv 6 call io drop ;
+			:start
+			`+code, "Canvas", vm.Canvas(img))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return i
+	}
+
+	i := draw("-2 5 call io -3 5 call io -4 5 call io")
+	assertEqual(t, "Canvas caps", "[-1 8 6]", fmt.Sprint(i.Data()))
+
+	draw("15 1 call cv 10 call cv 0 1 call cv 1 1 4 6 4 call cv")
+	assertEqual(t, "Canvas filled rect", `########
+#......#
+#......#
+#......#
+#......#
+########
+`, canvasString(img))
+	assertEqual(t, "Canvas color", "{255 255 255 255}", fmt.Sprint(img.RGBAAt(0, 0)))
+
+	draw("0 1 call cv 10 call cv 12 1 call cv 0 0 7 5 9 call cv 3 0 6 5 call cv 7 0 2 call cv")
+	assertEqual(t, "Canvas lines", `#..#...#
+.###....
+...#....
+...##...
+...#.##.
+...#...#
+`, canvasString(img))
+	assertEqual(t, "Canvas red", "{255 0 0 255}", fmt.Sprint(img.RGBAAt(0, 0)))
+
+	draw("0 1 call cv 10 call cv 1193046 1 call cv 3 3 2 7 call cv 0 0 3 3 3 call cv")
+	assertEqual(t, "Canvas circle", `###.....
+#.###...
+###..#..
+.#...#..
+.#...#..
+..###...
+`, canvasString(img))
+	assertEqual(t, "Canvas rgb", "{18 52 86 255}", fmt.Sprint(img.RGBAAt(3, 1)))
+
+	// huge coordinates are clipped
+	draw("0 1 call cv 10 call cv 15 1 call cv -4611686018427387904 -4611686018427387904 4611686018427387904 4611686018427387904 9 call cv")
+	assertEqual(t, "Canvas clipped line", `#.......
+.#......
+..#.....
+...#....
+....#...
+.....#..
+`, canvasString(img))
+	draw("0 1 call cv 10 call cv 15 1 call cv 3 3 4611686018427387904 7 call cv -4611686018427387904 0 100 8 call cv 100 100 200 -50 9 call cv")
+	assertEqual(t, "Canvas huge circle", `........
+........
+........
+........
+........
+........
+`, canvasString(img))
+}
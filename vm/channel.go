@@ -0,0 +1,234 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import "sync"
+
+// A Channel is a bounded queue of messages that connects VM instances, possibly
+// running in different goroutines. Messages are blocks of cells. Channels are
+// made available to guest programs with the Channels option and can be used
+// from the host with the Send, Recv and Close methods.
+//
+// A Channel is safe for concurrent use.
+type Channel struct {
+	mu     sync.Mutex
+	cond   sync.Cond
+	q      [][]Cell
+	size   int
+	closed bool
+}
+
+// NewChannel returns a new Channel that can hold up to size messages. If size is
+// less than 1, the channel holds 1 message.
+func NewChannel(size int) *Channel {
+	if size < 1 {
+		size = 1
+	}
+	c := &Channel{size: size}
+	c.cond.L = &c.mu
+	return c
+}
+
+// send queues a copy of msg. If wait is true, it waits until there is room in
+// the queue. It returns ErrnoEOF if the channel is closed and ErrnoAgain if
+// wait is false and the queue is full.
+func (c *Channel) send(msg []Cell, wait bool) Errno {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for wait && !c.closed && len(c.q) >= c.size {
+		c.cond.Wait()
+	}
+	switch {
+	case c.closed:
+		return ErrnoEOF
+	case len(c.q) >= c.size:
+		return ErrnoAgain
+	}
+	c.q = append(c.q, append([]Cell(nil), msg...))
+	c.cond.Broadcast()
+	return ErrnoOK
+}
+
+// recv removes the next message from the queue. If wait is true, it waits
+// until a message is available. It returns ErrnoEOF if the channel is closed
+// and empty and ErrnoAgain if wait is false and the queue is empty.
+func (c *Channel) recv(wait bool) ([]Cell, Errno) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for wait && !c.closed && len(c.q) == 0 {
+		c.cond.Wait()
+	}
+	switch {
+	case len(c.q) > 0:
+		msg := c.q[0]
+		c.q[0] = nil
+		c.q = c.q[1:]
+		c.cond.Broadcast()
+		return msg, ErrnoOK
+	case c.closed:
+		return nil, ErrnoEOF
+	}
+	return nil, ErrnoAgain
+}
+
+// Send queues a copy of msg, waiting until there is room in the queue. It
+// returns false if the channel is closed.
+func (c *Channel) Send(msg []Cell) bool {
+	return c.send(msg, true) == ErrnoOK
+}
+
+// Recv returns the next message, waiting until one is available. It returns
+// false if the channel is closed and all queued messages have been received.
+func (c *Channel) Recv() ([]Cell, bool) {
+	msg, e := c.recv(true)
+	return msg, e == ErrnoOK
+}
+
+// Len returns the number of queued messages.
+func (c *Channel) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.q)
+}
+
+// Close closes the channel. Pending and future sends fail. Messages already
+// queued can still be received, after which receives fail. Closing a closed
+// channel does nothing.
+func (c *Channel) Close() {
+	c.mu.Lock()
+	c.closed = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+}
+
+// Channels binds a channel device to the given WAIT port. The suggested port is
+// 15. Guest programs refer to the channels by their position in chans, starting
+// at 1. The following requests are supported (stack effects in parentheses):
+//
+//	1  send     ( addr count ch -- f )
+//	2  recv     ( addr max ch -- n )
+//	3  try send ( addr count ch -- f )
+//	4  try recv ( addr max ch -- n )
+//	5  close    ( ch -- f )
+//	6  length   ( ch -- n )
+//
+// Send queues the count cells starting at addr as one message, waiting until
+// there is room in the queue. It returns -1 on success, 0 on failure. Recv
+// waits for a message, copies at most max cells of it to memory starting at
+// addr and returns the length of the message, which may be greater than max,
+// or -1 on failure. Try send and try recv behave like send and recv but fail
+// with ErrnoAgain instead of waiting. Close returns -1, or 0 if ch is invalid.
+// Length returns the number of queued messages.
+//
+// Sending to a closed channel, or receiving from a closed channel once all its
+// messages have been received, fails with ErrnoEOF. Invalid channel numbers
+// fail with ErrnoBadFD. The error code is returned by port 4 request -11 (see
+// Errno).
+//
+// A pending send or receive request is not interrupted by Stop. Guests that
+// wait on a channel must make sure that it is eventually closed, or use the
+// non-blocking requests.
+func Channels(port Cell, chans ...*Channel) Option {
+	return func(i *Instance) error {
+		d := &channelDevice{chans: append([]*Channel(nil), chans...)}
+		i.bindWaitHandler(port, d.wait)
+		return nil
+	}
+}
+
+type channelDevice struct {
+	chans []*Channel
+}
+
+func (d *channelDevice) get(i *Instance, ch Cell) *Channel {
+	if ch < 1 || ch > Cell(len(d.chans)) {
+		i.errno = ErrnoBadFD
+		return nil
+	}
+	return d.chans[ch-1]
+}
+
+func (d *channelDevice) wait(i *Instance, v, port Cell) error {
+	i.errno = ErrnoOK
+	var r Cell
+	switch v {
+	case 1, 3: // send, try send
+		ch, count, addr := i.Pop(), i.Pop(), i.Pop()
+		if !i.inMem(addr, count) {
+			i.errno = ErrnoInvalid
+			break
+		}
+		msg := i.Mem[addr : addr+count]
+		r, _ = i.devCall(func() (Cell, []Cell) {
+			c := d.get(i, ch)
+			if c == nil {
+				return 0, nil
+			}
+			if i.errno = c.send(msg, v == 1); i.errno != ErrnoOK {
+				return 0, nil
+			}
+			return -1, nil
+		})
+	case 2, 4: // recv, try recv
+		ch, max, addr := i.Pop(), i.Pop(), i.Pop()
+		if !i.inMem(addr, max) {
+			i.errno = ErrnoInvalid
+			r = -1
+			break
+		}
+		var msg []Cell
+		r, msg = i.devCall(func() (Cell, []Cell) {
+			c := d.get(i, ch)
+			if c == nil {
+				return -1, nil
+			}
+			msg, e := c.recv(v == 2)
+			if i.errno = e; e != ErrnoOK {
+				return -1, nil
+			}
+			n := Cell(len(msg))
+			if n > max {
+				msg = msg[:max]
+			}
+			return n, msg
+		})
+		i.UnshareMem()
+		copy(i.Mem[addr:], msg)
+	case 5: // close
+		ch := i.Pop()
+		r, _ = i.devCall(func() (Cell, []Cell) {
+			c := d.get(i, ch)
+			if c == nil {
+				return 0, nil
+			}
+			c.Close()
+			return -1, nil
+		})
+	case 6: // length
+		ch := i.Pop()
+		r, _ = i.devCall(func() (Cell, []Cell) {
+			if c := d.get(i, ch); c != nil {
+				return Cell(c.Len()), nil
+			}
+			return 0, nil
+		})
+	default:
+		i.errno = ErrnoInvalid
+	}
+	i.WaitReply(r, port)
+	return nil
+}
@@ -0,0 +1,102 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/dobegor/ngaro/vm"
+)
+
+func TestChannels(t *testing.T) {
+	ch, res := vm.NewChannel(1), vm.NewChannel(4)
+	prod := make(chan error, 1)
+	go func() {
+		// send messages of length 1 to 3 with the values 1 to 6
+		_, err := runAsmImage(`jump start
+			.org 32
+			:io dup push out 0 0 out wait pop in ;
+			:msg .dat 1
+			     .dat 2
+			     .dat 3
+			     .dat 4
+			     .dat 5
+			     .dat 6
+			:start
+			lit msg 1 1 1 15 call io
+			lit msg 1 + 2 1 1 15 call io
+			lit msg 3 + 3 1 1 15 call io
+			1 5 15 call io
+			`, "Producer", vm.Channels(15, ch))
+		prod <- err
+	}()
+
+	// sum the received messages, send the message lengths and sum to the
+	// second channel
+	i, err := runAsmImage(`jump start
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:sum .dat 0
+		:len .dat 0
+		:buf .dat 0
+		     .dat 0
+		     .dat 0
+		     .dat 0
+		:start
+			lit buf 4 1 2 15 call io
+			dup -1 =jump done
+			dup lit len !
+			lit buf swap
+		:1	push dup @ lit sum @ + lit sum ! 1+ pop loop 1-
+			drop
+			lit len 1 2 1 15 call io drop
+			jump start
+		:done
+			drop
+			-11 4 call io
+			lit sum 1 2 1 15 call io drop
+			lit buf 4 3 4 15 call io
+			-11 4 call io
+			0 5 15 call io
+			-11 4 call io
+		`, "Consumer", vm.Channels(15, ch, res, vm.NewChannel(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-prod; err != nil {
+		t.Fatal(err)
+	}
+	// try recv on an empty channel fails with ErrnoAgain, closing channel 0
+	// fails with ErrnoBadFD
+	assertEqual(t, "Consumer", fmt.Sprintf("[%d -1 %d 0 %d]", vm.ErrnoEOF, vm.ErrnoAgain, vm.ErrnoBadFD), fmt.Sprint(i.Data()))
+
+	var got []vm.Cell
+	for res.Len() > 0 {
+		msg, _ := res.Recv()
+		got = append(got, msg...)
+	}
+	assertEqual(t, "Results", "[1 2 3 21]", fmt.Sprint(got))
+
+	res.Close()
+	if res.Send([]vm.Cell{1}) {
+		t.Error("send on closed channel succeeded")
+	}
+	if _, ok := res.Recv(); ok {
+		t.Error("recv on closed channel succeeded")
+	}
+}
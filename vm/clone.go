@@ -0,0 +1,136 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import "sync/atomic"
+
+// memShare keeps track of the number of instances sharing the same memory
+// image.
+type memShare struct {
+	refs int32
+}
+
+// Clone returns a new, independent VM instance in the same state as i.
+//
+// The memory image is shared copy-on-write: both instances keep using the same
+// backing array until either of them writes to it, at which point the writer
+// gets its own private copy. The data and address stacks as well as the I/O
+// ports are duplicated. Registered IN, OUT and WAIT handlers, the opcode
+// handler, the Codec, the ticker function, the Host, the Policy and the output
+// Terminal are shared with the original instance. If clones are run
+// concurrently, these must be safe for concurrent use. Functions bound with
+// Bind are shared too, but the clone gets its own function table: functions
+// bound to the clone are not visible to the original instance, and vice versa.
+//
+// The devices provided by this package are shared along with their state: the
+// socket table of Sockets, the responses of HTTPClient, the timers of Timer,
+// the generator of Random, the channels of Channels, the pointer state of
+// Mouse and the key queue of Keyboard. These devices are safe for concurrent
+// use, but descriptors returned to one instance are valid in all of them and
+// clones compete for key events. Canvas draws without locking, so clones that
+// run concurrently must not use it.
+//
+// The clone starts with an empty input stack and no open files. Input can be
+// added with PushInput. It does not inherit any Record or Replay option.
+//
+// Clone must not be called while the VM is running, except from a ticker
+// function.
+func (i *Instance) Clone() *Instance {
+	if i.share == nil {
+		i.share = &memShare{refs: 1}
+	}
+	atomic.AddInt32(&i.share.refs, 1)
+
+	c := &Instance{
+		PC:        i.PC,
+		Mem:       i.Mem,
+		Ports:     append([]Cell(nil), i.Ports...),
+		tos:       i.tos,
+		sp:        i.sp,
+		rsp:       i.rsp,
+		rtos:      i.rtos,
+		data:      append([]Cell(nil), i.data...),
+		address:   append([]Cell(nil), i.address...),
+		insCount:  i.insCount,
+		insBase:   i.insBase,
+		inH:       make(map[Cell]InHandler, len(i.inH)),
+		outH:      make(map[Cell]OutHandler, len(i.outH)),
+		waitH:     make(map[Cell]WaitHandler, len(i.waitH)),
+		waitP:     append([]Cell(nil), i.waitP...),
+		sEnc:      i.sEnc,
+		opHandler: i.opHandler,
+		imageFile: i.imageFile,
+		output:    i.output,
+		clock:     i.clock,
+		env:       i.env,
+		fs:        i.fs,
+		fid:       1,
+		files:     make(map[Cell]File),
+		memDump:   i.memDump,
+		tickMask:  i.tickMask,
+		tickFn:    i.tickFn,
+		share:     i.share,
+		policy:    i.policy,
+		errno:     i.errno,
+		mouse:     i.mouse,
+		keyboard:  i.keyboard,
+		bridge:    i.bridge.clone(),
+	}
+	for p, h := range i.inH {
+		c.inH[p] = h
+	}
+	for p, h := range i.outH {
+		c.outH[p] = h
+	}
+	for p, h := range i.waitH {
+		c.waitH[p] = h
+	}
+	if i.devCaps != nil {
+		c.devCaps = make(map[Cell]Cell, len(i.devCaps))
+		for q, v := range i.devCaps {
+			c.devCaps[q] = v
+		}
+	}
+	return c
+}
+
+// UnshareMem makes sure that the instance owns a private copy of its memory
+// image. The VM calls it automatically before writing to memory. Host code that
+// writes directly to the Mem field of an instance that has been cloned (or of a
+// clone) must call it first.
+func (i *Instance) UnshareMem() {
+	s := i.share
+	if s == nil {
+		return
+	}
+	i.share = nil
+	if atomic.LoadInt32(&s.refs) > 1 {
+		mem := make([]Cell, len(i.Mem))
+		copy(mem, i.Mem)
+		i.Mem = mem
+	}
+	atomic.AddInt32(&s.refs, -1)
+}
+
+// releaseMem drops the reference to the memory image without copying it.
+func (i *Instance) releaseMem() {
+	if s := i.share; s != nil {
+		i.share = nil
+		atomic.AddInt32(&s.refs, -1)
+	}
+	i.Mem = nil
+}
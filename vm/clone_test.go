@@ -0,0 +1,96 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dobegor/ngaro/asm"
+	"github.com/dobegor/ngaro/vm"
+)
+
+func TestInstance_Clone(t *testing.T) {
+	img, err := asm.Assemble("Clone", strings.NewReader(`
+		jump start
+	:cnt .dat 0
+	:start
+		lit cnt @ 1+ dup lit cnt !
+		42 in`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := vm.New(img, "Clone", vm.BindInHandler(42, func(i *vm.Instance, p vm.Cell) error {
+		i.Push(100)
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.Push(7)
+	i.Rpush(8)
+
+	c := i.Clone()
+	if &c.Mem[0] != &i.Mem[0] {
+		t.Fatal("memory not shared after Clone")
+	}
+	if err = c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqualI(t, "Clone data", 3, c.Depth())
+	assertEqualI(t, "Clone in handler", 100, int(c.Pop()))
+	assertEqualI(t, "Clone counter", 1, int(c.Pop()))
+	assertEqualI(t, "Clone original counter", 0, int(i.Mem[2]))
+	assertEqualI(t, "Clone original data", 1, i.Depth())
+	assertEqualI(t, "Clone original PC", 0, i.PC)
+	if &c.Mem[0] == &i.Mem[0] {
+		t.Fatal("memory still shared after write")
+	}
+
+	// handlers bound to the clone do not leak into the original
+	c.SetOptions(vm.BindInHandler(42, func(i *vm.Instance, p vm.Cell) error {
+		i.Push(200)
+		return nil
+	}))
+	if err = i.Run(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqualI(t, "Clone original in handler", 100, int(i.Pop()))
+	assertEqualI(t, "Clone original counter", 1, int(i.Mem[2]))
+	assertEqualI(t, "Clone original rstack", 8, int(i.Rpop()))
+	assertEqualI(t, "Clone rstack", 8, int(c.Rpop()))
+}
+
+func TestInstance_UnshareMem(t *testing.T) {
+	i, err := vm.New(make([]vm.Cell, 4), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1 := i.Clone()
+	c2 := c1.Clone()
+	c1.UnshareMem()
+	c1.Mem[0] = 1
+	assertEqualI(t, "UnshareMem original", 0, int(i.Mem[0]))
+	assertEqualI(t, "UnshareMem clone", 0, int(c2.Mem[0]))
+	i.UnshareMem()
+	// c2 is now the sole owner of the original memory, no copy needed
+	m := &c2.Mem[0]
+	c2.UnshareMem()
+	if m != &c2.Mem[0] {
+		t.Fatal("sole owner copied its memory")
+	}
+}
@@ -0,0 +1,185 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"encoding/binary"
+	"unicode/utf8"
+)
+
+// Standard Codec implementations.
+//
+// All of them check bounds against len(mem): Decode stops at the end of mem if
+// the string is not terminated and returns nil if start is out of range.
+// Encode truncates strings that do not fit in mem, always leaving room for the
+// terminator or length, and does nothing if start is out of range.
+var (
+	// ByteCodec stores one byte per cell, followed by a 0 cell. This is the
+	// encoding used by Retro.
+	ByteCodec Codec = byteCodec{}
+
+	// CountedCodec stores the length of the string in the first cell,
+	// followed by one byte per cell.
+	CountedCodec Codec = countedCodec{}
+
+	// UTF32Codec stores one Unicode code point per cell, followed by a 0 cell.
+	// Strings are converted from and to UTF-8. Invalid code points decode as
+	// utf8.RuneError.
+	UTF32Codec Codec = utf32Codec{}
+
+	// PackedCodec stores 8 bytes per cell in little-endian order. The string
+	// ends with the first 0 byte. If its length is a multiple of 8, it is
+	// followed by a 0 cell.
+	PackedCodec Codec = packedCodec{}
+)
+
+// inRange returns true if start is a valid address in mem.
+func inRange(mem []Cell, start Cell) bool {
+	return start >= 0 && int(start) < len(mem)
+}
+
+type byteCodec struct{}
+
+func (byteCodec) Decode(mem []Cell, start Cell) []byte {
+	if !inRange(mem, start) {
+		return nil
+	}
+	var b []byte
+	for _, c := range mem[start:] {
+		if c == 0 {
+			break
+		}
+		b = append(b, byte(c))
+	}
+	return b
+}
+
+func (byteCodec) Encode(mem []Cell, start Cell, s []byte) {
+	if !inRange(mem, start) {
+		return
+	}
+	m := mem[start:]
+	if len(s) >= len(m) {
+		s = s[:len(m)-1]
+	}
+	for k, c := range s {
+		m[k] = Cell(c)
+	}
+	m[len(s)] = 0
+}
+
+type countedCodec struct{}
+
+func (countedCodec) Decode(mem []Cell, start Cell) []byte {
+	if !inRange(mem, start) || mem[start] < 0 {
+		return nil
+	}
+	m := mem[start+1:]
+	if n := int(mem[start]); n < len(m) {
+		m = m[:n]
+	}
+	b := make([]byte, len(m))
+	for k, c := range m {
+		b[k] = byte(c)
+	}
+	return b
+}
+
+func (countedCodec) Encode(mem []Cell, start Cell, s []byte) {
+	if !inRange(mem, start) {
+		return
+	}
+	m := mem[start+1:]
+	if len(s) > len(m) {
+		s = s[:len(m)]
+	}
+	mem[start] = Cell(len(s))
+	for k, c := range s {
+		m[k] = Cell(c)
+	}
+}
+
+type utf32Codec struct{}
+
+func (utf32Codec) Decode(mem []Cell, start Cell) []byte {
+	if !inRange(mem, start) {
+		return nil
+	}
+	var b []byte
+	for _, c := range mem[start:] {
+		if c == 0 {
+			break
+		}
+		r := rune(c)
+		if Cell(r) != c || !utf8.ValidRune(r) {
+			r = utf8.RuneError
+		}
+		b = utf8.AppendRune(b, r)
+	}
+	return b
+}
+
+func (utf32Codec) Encode(mem []Cell, start Cell, s []byte) {
+	if !inRange(mem, start) {
+		return
+	}
+	m := mem[start:]
+	n := 0
+	for len(s) > 0 && n < len(m)-1 {
+		r, size := utf8.DecodeRune(s)
+		s = s[size:]
+		m[n] = Cell(r)
+		n++
+	}
+	m[n] = 0
+}
+
+type packedCodec struct{}
+
+func (packedCodec) Decode(mem []Cell, start Cell) []byte {
+	if !inRange(mem, start) {
+		return nil
+	}
+	var b []byte
+	var buf [8]byte
+	for _, c := range mem[start:] {
+		binary.LittleEndian.PutUint64(buf[:], uint64(c))
+		for _, v := range buf {
+			if v == 0 {
+				return b
+			}
+			b = append(b, v)
+		}
+	}
+	return b
+}
+
+func (packedCodec) Encode(mem []Cell, start Cell, s []byte) {
+	if !inRange(mem, start) {
+		return
+	}
+	m := mem[start:]
+	if max := len(m)*8 - 1; len(s) > max {
+		s = s[:max]
+	}
+	var buf [8]byte
+	for k := 0; k <= len(s)/8; k++ {
+		buf = [8]byte{}
+		copy(buf[:], s[k*8:])
+		m[k] = Cell(binary.LittleEndian.Uint64(buf[:]))
+	}
+}
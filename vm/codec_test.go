@@ -0,0 +1,83 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/dobegor/ngaro/vm"
+)
+
+func TestCodecs(t *testing.T) {
+	codecs := []struct {
+		name  string
+		c     vm.Codec
+		cells int // cells used by "héllo wörld!"
+	}{
+		{"Byte", vm.ByteCodec, 15},
+		{"Counted", vm.CountedCodec, 15},
+		{"UTF32", vm.UTF32Codec, 13},
+		{"Packed", vm.PackedCodec, 2},
+	}
+	for _, tc := range codecs {
+		for _, s := range []string{"", "a", "12345678", "héllo wörld!"} {
+			mem := make([]vm.Cell, 32)
+			tc.c.Encode(mem, 3, []byte(s))
+			assertEqual(t, tc.name+" round trip", s, string(tc.c.Decode(mem, 3)))
+			assertEqual(t, tc.name+" start", "[0 0 0]", fmt.Sprint(mem[:3]))
+		}
+
+		// bounds: the string must be truncated to fit, with its terminator
+		s := "héllo wörld!"
+		mem := make([]vm.Cell, tc.cells)
+		tc.c.Encode(mem, 0, []byte(s))
+		assertEqual(t, tc.name+" fit", s, string(tc.c.Decode(mem, 0)))
+		mem = make([]vm.Cell, tc.cells)
+		tc.c.Encode(mem[:tc.cells-1], 0, []byte(s))
+		if d := string(tc.c.Decode(mem, 0)); d == s || len(d) == 0 {
+			t.Errorf("%s: expected truncated string, got %q", tc.name, d)
+		}
+		assertEqual(t, tc.name+" overflow", "0", fmt.Sprint(mem[tc.cells-1]))
+
+		// unterminated strings end at the end of mem
+		mem = []vm.Cell{0x41, 0x42, 0x43}
+		if tc.c == vm.CountedCodec {
+			mem[0] = 100
+		}
+		if d := tc.c.Decode(mem, 0); len(d) == 0 {
+			t.Errorf("%s: unterminated string decoded as empty", tc.name)
+		}
+		tc.c.Encode(mem, 3, []byte("x"))
+		tc.c.Encode(mem, -1, []byte("x"))
+		assertEqual(t, tc.name+" out of range", "", string(tc.c.Decode(mem, 3)))
+		assertEqual(t, tc.name+" negative", "", string(tc.c.Decode(mem, -1)))
+	}
+
+	// layouts
+	mem := make([]vm.Cell, 4)
+	vm.CountedCodec.Encode(mem, 0, []byte("ab"))
+	assertEqual(t, "Counted layout", "[2 97 98 0]", fmt.Sprint(mem))
+	vm.UTF32Codec.Encode(mem, 0, []byte("é€"))
+	assertEqual(t, "UTF32 layout", "[233 8364 0 0]", fmt.Sprint(mem))
+	mem[0] = -5
+	assertEqual(t, "UTF32 invalid", "�€", string(vm.UTF32Codec.Decode(mem, 0)))
+	vm.PackedCodec.Encode(mem, 0, []byte("abcdefghi"))
+	abcdefgh := vm.Cell(binary.LittleEndian.Uint64([]byte("abcdefgh")))
+	assertEqual(t, "Packed layout", fmt.Sprint([]vm.Cell{abcdefgh, 0x69, 0, 0}), fmt.Sprint(mem))
+}
@@ -17,6 +17,8 @@
 package vm
 
 import (
+	"sync/atomic"
+
 	"github.com/pkg/errors"
 )
 
@@ -141,15 +143,40 @@ func (i *Instance) Rpop() Cell {
 	return rtos
 }
 
+// Stop requests the VM to stop. Run returns nil before executing the next
+// instruction and closes the returned channel. Stop can be called from any
+// goroutine.
 func (i *Instance) Stop() <-chan struct{} {
-	i.stopCh = make(chan struct{})
+	i.stopMu.Lock()
+	defer i.stopMu.Unlock()
+	if i.stopCh == nil {
+		i.stopCh = make(chan struct{})
+	}
+	atomic.StoreInt32(&i.stopReq, 1)
 	return i.stopCh
 }
 
+// Stopped returns true if the last call to Run returned because of a call to
+// Stop.
 func (i *Instance) Stopped() bool {
+	i.stopMu.Lock()
+	defer i.stopMu.Unlock()
 	return i.stopped
 }
 
+// stop acknowledges a stop request. If closeCh is false, pending requests are
+// discarded without closing the channel returned by Stop.
+func (i *Instance) stop(closeCh bool) {
+	i.stopMu.Lock()
+	defer i.stopMu.Unlock()
+	if closeCh && i.stopCh != nil {
+		i.stopped = true
+		close(i.stopCh)
+	}
+	i.stopCh = nil
+	atomic.StoreInt32(&i.stopReq, 0)
+}
+
 // Run starts execution of the VM.
 //
 // If an error occurs, the PC will will point to the instruction that triggered
@@ -181,8 +208,17 @@ func (i *Instance) Stopped() bool {
 // If the last input stream gets closed, the VM will exit and the root cause
 // error will be io.EOF. This is a normal exit condition in most use cases.
 func (i *Instance) Run() (err error) {
+	i.stopMu.Lock()
 	i.stopped = false
+	i.stopMu.Unlock()
 
+	if i.tape != nil {
+		defer func() {
+			if e := i.tape.flush(); err == nil {
+				err = e
+			}
+		}()
+	}
 	defer func() {
 		if e := recover(); e != nil {
 			switch e := e.(type) {
@@ -195,12 +231,11 @@ func (i *Instance) Run() (err error) {
 		}
 	}()
 
+	i.insBase += i.insCount
 	i.insCount = 0
 	for i.PC < len(i.Mem) {
-		if i.stopCh != nil {
-			i.stopped = true
-			close(i.stopCh)
-			i.stopCh = nil
+		if atomic.LoadInt32(&i.stopReq) != 0 {
+			i.stop(true)
 			return nil
 		}
 
@@ -272,6 +307,9 @@ func (i *Instance) Run() (err error) {
 			i.tos = i.Mem[i.tos]
 			i.PC++
 		case OpStore:
+			if i.share != nil {
+				i.UnshareMem()
+			}
 			i.Mem[i.tos] = i.data[i.sp]
 			i.Drop2()
 			i.PC++
@@ -329,7 +367,7 @@ func (i *Instance) Run() (err error) {
 			port := i.tos
 			if h := i.inH[port]; h != nil {
 				i.Pop()
-				if err = h(i, port); err != nil {
+				if err = i.callIn(h, port); err != nil {
 					return errors.Wrap(err, "IN failed")
 				}
 			} else {
@@ -352,11 +390,19 @@ func (i *Instance) Run() (err error) {
 			i.PC++
 		case OpWait:
 			if i.Ports[0] != 1 {
-				for p, h := range i.waitH {
+				for _, p := range i.waitP {
 					v := i.Ports[p]
 					if v == 0 {
 						continue
 					}
+					h := i.waitH[p]
+					if h == nil {
+						continue
+					}
+					if i.policy != nil && isDevicePort(p) && !i.allow(CapDevice, p, "", v) {
+						i.WaitReply(0, p)
+						continue
+					}
 					if err = h(i, v, p); err != nil {
 						return errors.Wrap(err, "WAIT failed")
 					}
@@ -403,6 +403,10 @@ func TestVM_InstructionCount(t *testing.T) {
 		t.Fatal(err)
 	}
 	assertEqualI(t, "VM_InstructionCount", 11, int(i.InstructionCount()))
+	if err = i.Run(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqualI(t, "VM_InstructionCount reset", 0, int(i.InstructionCount()))
 }
 
 func TestVM_DataSize(t *testing.T) {
@@ -0,0 +1,350 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultSnapshotInterval = 1 << 16
+	maxSnapshots            = 64
+)
+
+// Debugger controls the execution of a VM instance with breakpoints and
+// watchpoints, and can step back in time.
+//
+// Reverse execution works by taking periodic snapshots of the VM while it runs
+// and by re-executing it from the closest snapshot while replaying all inputs
+// recorded in the meantime (see Record and Replay). While stepped back, the
+// Instance method returns a reconstructed copy of the VM: its output is
+// discarded, and neither image saves nor file writes are performed. The
+// debugger switches back to the original instance once the copy catches up
+// with it.
+//
+// Custom WAIT and OUT handlers and custom opcodes are also called during
+// re-execution, so they must be deterministic and free of side effects outside
+// of the VM in order to get accurate results. Ticker functions are not called
+// during re-execution.
+//
+// The options of the debugged instance must not be changed until Detach is
+// called.
+type Debugger struct {
+	live     *Instance
+	cur      *Instance
+	log      bytes.Buffer
+	snaps    []snapshot
+	interval int64
+	next     int64
+	bp       map[int]bool
+	wp       map[int]bool
+	tickFn   func(i *Instance)
+	tickMask int64
+}
+
+type snapshot struct {
+	i   *Instance
+	off int               // offset in the input log
+	fid Cell              // next file ID
+	fds map[Cell]*dirFile // open files, nil for regular files
+}
+
+// NewDebugger attaches a new Debugger to the given instance. A snapshot of the
+// VM is taken every interval instructions. If interval <= 0, a default of 65536
+// is used. Older snapshots are thinned out as the number of instructions
+// executed grows.
+//
+// Instances configured with the Record or Replay options cannot be debugged.
+func NewDebugger(i *Instance, interval int64) (*Debugger, error) {
+	if i.tape != nil {
+		return nil, errors.New("instance is already recording or replaying")
+	}
+	if interval <= 0 {
+		interval = defaultSnapshotInterval
+	}
+	d := &Debugger{
+		live:     i,
+		cur:      i,
+		interval: interval,
+		bp:       make(map[int]bool),
+		wp:       make(map[int]bool),
+		tickFn:   i.tickFn,
+		tickMask: i.tickMask,
+	}
+	i.tape = &tape{w: &d.log}
+	d.snapshot()
+	return d, nil
+}
+
+// Instance returns the VM instance in its current state. This is either the
+// debugged instance or a reconstructed copy if the debugger stepped back.
+func (d *Debugger) Instance() *Instance {
+	return d.cur
+}
+
+// Detach stops debugging and returns the debugged instance, which can then be
+// run normally. The debugger must not be used afterwards.
+func (d *Debugger) Detach() *Instance {
+	i := d.live
+	i.tape = nil
+	i.tickFn, i.tickMask = d.tickFn, d.tickMask
+	for k := range d.snaps {
+		d.snaps[k].i.releaseMem()
+	}
+	d.snaps, d.cur = nil, i
+	return i
+}
+
+// SetBreakpoint sets a breakpoint at the given address. Execution stops before
+// the instruction at this address is executed.
+func (d *Debugger) SetBreakpoint(pc int) {
+	d.bp[pc] = true
+}
+
+// ClearBreakpoint removes the breakpoint at the given address.
+func (d *Debugger) ClearBreakpoint(pc int) {
+	delete(d.bp, pc)
+}
+
+// SetWatchpoint sets a watchpoint on the given memory address. Execution stops
+// right after an instruction that changed the value at this address.
+func (d *Debugger) SetWatchpoint(addr int) error {
+	if addr < 0 || addr >= len(d.live.Mem) {
+		return errors.Errorf("watchpoint address %d out of range", addr)
+	}
+	d.wp[addr] = true
+	return nil
+}
+
+// ClearWatchpoint removes the watchpoint on the given memory address.
+func (d *Debugger) ClearWatchpoint(addr int) {
+	delete(d.wp, addr)
+}
+
+// Step executes a single instruction.
+func (d *Debugger) Step() error {
+	return d.forward(d.cur.position()+1, nil)
+}
+
+// Continue resumes execution until a breakpoint or watchpoint is hit, or the
+// VM exits.
+func (d *Debugger) Continue() error {
+	return d.forward(-1, d.hitFn(d.cur))
+}
+
+// StepBack goes back to the state the VM was in before the last instruction
+// was executed.
+func (d *Debugger) StepBack() error {
+	n := d.cur.position() - 1
+	if n < d.snaps[0].i.position() {
+		return errors.New("no execution history")
+	}
+	return d.seek(n)
+}
+
+// ReverseContinue goes back in time to the last breakpoint or watchpoint hit.
+// If there is none, it goes back to the state the VM was in when the debugger
+// was attached.
+func (d *Debugger) ReverseContinue() error {
+	limit := d.cur.position() - 1
+	for k := len(d.snaps) - 1; k >= 0; k-- {
+		s := &d.snaps[k]
+		start := s.i.position()
+		if start > limit {
+			continue
+		}
+		c := d.restore(s)
+		last := int64(-1)
+		if d.bp[c.PC] {
+			last = start
+		}
+		hit := d.hitFn(c)
+		_, err := d.exec(c, limit, func(i *Instance) bool {
+			if hit(i) {
+				last = i.position()
+			}
+			return false
+		})
+		if err != nil {
+			return err
+		}
+		if last >= 0 {
+			return d.seek(last)
+		}
+		// watchpoint hits at start are detected from the previous snapshot
+		limit = start
+	}
+	return d.seek(d.snaps[0].i.position())
+}
+
+// hitFn returns a function that checks for breakpoint and watchpoint hits
+// after each instruction executed by i.
+func (d *Debugger) hitFn(i *Instance) func(i *Instance) bool {
+	watch := make(map[int]Cell, len(d.wp))
+	for a := range d.wp {
+		watch[a] = i.Mem[a]
+	}
+	return func(i *Instance) bool {
+		hit := d.bp[i.PC]
+		for a, v := range watch {
+			if nv := i.Mem[a]; nv != v {
+				watch[a] = nv
+				hit = true
+			}
+		}
+		return hit
+	}
+}
+
+// forward runs the current instance until it has executed until instructions
+// (if until >= 0) or stop returns true.
+func (d *Debugger) forward(until int64, stop func(i *Instance) bool) error {
+	if d.cur != d.live {
+		lim := d.live.position()
+		if until >= 0 && until < lim {
+			lim = until
+		}
+		hit, err := d.exec(d.cur, lim, stop)
+		if err != nil || hit || d.cur.position() < d.live.position() {
+			return err
+		}
+		// caught up with the live instance
+		d.cur = d.live
+	}
+	_, err := d.exec(d.live, until, stop)
+	return err
+}
+
+// exec runs i until it has executed until instructions (if until >= 0) or stop
+// returns true, in which case hit will be true.
+func (d *Debugger) exec(i *Instance, until int64, stop func(i *Instance) bool) (hit bool, err error) {
+	if i.position() == until {
+		return false, nil
+	}
+	live := i == d.live
+	i.tickMask = 0
+	i.tickFn = func(i *Instance) {
+		if live {
+			if d.tickFn != nil && i.insCount&d.tickMask == 0 {
+				d.tickFn(i)
+			}
+			if i.position() >= d.next {
+				d.snapshot()
+			}
+		}
+		if stop != nil && stop(i) {
+			hit = true
+			i.Stop()
+		} else if i.position() == until {
+			i.Stop()
+		}
+	}
+	err = i.Run()
+	i.stop(false)
+	return hit, err
+}
+
+// seek sets the current instance to the state of the VM after n instructions.
+func (d *Debugger) seek(n int64) error {
+	if n == d.live.position() {
+		d.cur = d.live
+		return nil
+	}
+	var s *snapshot
+	for k := len(d.snaps) - 1; k >= 0; k-- {
+		if d.snaps[k].i.position() <= n {
+			s = &d.snaps[k]
+			break
+		}
+	}
+	if s == nil {
+		return errors.New("no execution history")
+	}
+	c := d.restore(s)
+	if _, err := d.exec(c, n, nil); err != nil {
+		return err
+	}
+	d.cur = c
+	return nil
+}
+
+// snapshot takes a snapshot of the live instance.
+func (d *Debugger) snapshot() {
+	i := d.live
+	s := snapshot{i: i.Clone(), off: d.log.Len(), fid: i.fid, fds: make(map[Cell]*dirFile)}
+	for fd, f := range i.files {
+		switch f := f.(type) {
+		case nil:
+		case *dirFile:
+			c := *f
+			s.fds[fd] = &c
+		default:
+			s.fds[fd] = nil
+		}
+	}
+	d.snaps = append(d.snaps, s)
+	if len(d.snaps) > maxSnapshots {
+		// keep every other snapshot
+		n := 1
+		for k := 1; k < len(d.snaps); k++ {
+			if k&1 == 0 {
+				d.snaps[n] = d.snaps[k]
+				n++
+			} else {
+				d.snaps[k].i.releaseMem()
+			}
+		}
+		d.snaps = d.snaps[:n]
+		d.interval *= 2
+	}
+	d.next = i.position() + d.interval
+}
+
+// restore returns a new instance in the state of the given snapshot, set up to
+// replay recorded inputs.
+func (d *Debugger) restore(s *snapshot) *Instance {
+	c := s.i.Clone()
+	c.tape = &tape{r: bytes.NewReader(d.log.Bytes()[s.off:])}
+	c.fid = s.fid
+	for fd, f := range s.fds {
+		if f != nil {
+			d := *f
+			c.files[fd] = &d
+		} else {
+			c.files[fd] = &tapeFile{c, nil}
+		}
+	}
+	c.memDump = func(string, []Cell) error { return nil }
+	if out := d.live.output; out != nil {
+		c.output = discardTerminal(out.Port8Enabled())
+	}
+	return c
+}
+
+// discardTerminal is a Terminal that discards all output.
+type discardTerminal bool
+
+func (t discardTerminal) Write(p []byte) (int, error)   { return len(p), nil }
+func (t discardTerminal) Flush() error                  { return nil }
+func (t discardTerminal) Size() (width int, height int) { return 0, 0 }
+func (t discardTerminal) Clear()                        {}
+func (t discardTerminal) MoveCursor(x, y int)           {}
+func (t discardTerminal) FgColor(fg int)                {}
+func (t discardTerminal) BgColor(bg int)                {}
+func (t discardTerminal) Port8Enabled() bool            { return bool(t) }
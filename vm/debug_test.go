@@ -0,0 +1,125 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dobegor/ngaro/asm"
+	"github.com/dobegor/ngaro/vm"
+)
+
+func TestDebugger(t *testing.T) {
+	img, err := asm.Assemble("Debugger", strings.NewReader(`
+		jump start
+	:cnt	.dat 0
+	:last	.dat 0
+	:start
+		5
+	:0	dup lit cnt !
+		1 1 out 0 0 out wait 1 in lit last !
+		loop 0-
+	:end`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := vm.New(img, "Debugger", vm.Input(strings.NewReader("abcde")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := vm.NewDebugger(i, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.SetWatchpoint(2); err != nil {
+		t.Fatal(err)
+	}
+	state := func() string {
+		i := d.Instance()
+		return fmt.Sprintf("pc=%d cnt=%d last=%c data=%v", i.PC, i.Mem[2], rune(i.Mem[3]), i.Data())
+	}
+	expect := func(name, exp string) {
+		t.Helper()
+		if s := state(); s != exp {
+			t.Fatalf("%s:\nExpected: %s\nGot: %s", name, exp, s)
+		}
+	}
+	var counts []int64
+	for n := 0; n < 3; n++ {
+		if err = d.Continue(); err != nil {
+			t.Fatal(err)
+		}
+		counts = append(counts, d.Instance().InstructionCount())
+	}
+	expect("Continue", "pc=10 cnt=3 last=b data=[3]")
+
+	if err = d.ReverseContinue(); err != nil {
+		t.Fatal(err)
+	}
+	if d.Instance() == i {
+		t.Fatal("ReverseContinue did not switch to a reconstructed instance")
+	}
+	assertEqualI(t, "ReverseContinue count", int(counts[1]), int(d.Instance().InstructionCount()))
+	expect("ReverseContinue", "pc=10 cnt=4 last=a data=[4]")
+
+	if err = d.StepBack(); err != nil {
+		t.Fatal(err)
+	}
+	expect("StepBack", "pc=9 cnt=5 last=a data=[4 4 2]")
+	if err = d.Step(); err != nil {
+		t.Fatal(err)
+	}
+	expect("Step", "pc=10 cnt=4 last=a data=[4]")
+
+	d.SetBreakpoint(20)
+	if err = d.Continue(); err != nil {
+		t.Fatal(err)
+	}
+	expect("Breakpoint", "pc=20 cnt=4 last=a data=[4]")
+	if err = d.ReverseContinue(); err != nil {
+		t.Fatal(err)
+	}
+	expect("ReverseContinue watch", "pc=10 cnt=4 last=a data=[4]")
+	if err = d.ReverseContinue(); err != nil {
+		t.Fatal(err)
+	}
+	expect("ReverseContinue breakpoint", "pc=20 cnt=5 last=\x00 data=[5]")
+	d.ClearBreakpoint(20)
+	d.ClearWatchpoint(2)
+
+	// replay up to the live instance, then run to completion
+	if err = d.Continue(); err != nil {
+		t.Fatal(err)
+	}
+	if d.Instance() != i {
+		t.Fatal("Continue did not switch back to the live instance")
+	}
+	expect("Continue to end", "pc=29 cnt=1 last=e data=[]")
+
+	if err = d.ReverseContinue(); err != nil {
+		t.Fatal(err)
+	}
+	expect("ReverseContinue to start", "pc=0 cnt=0 last=\x00 data=[]")
+	if err = d.StepBack(); err == nil {
+		t.Fatal("Unexpected nil error")
+	}
+	if d.Detach() != i {
+		t.Fatal("Detach did not return the debugged instance")
+	}
+}
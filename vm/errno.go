@@ -0,0 +1,96 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Errno is an error code reported to guest programs by file operations on port
+// 4. Guest programs can query the error code of the last file operation with
+// port 4 request -11.
+//
+// Errno values are stable and will not be renumbered in future versions.
+type Errno Cell
+
+// Error codes.
+const (
+	ErrnoOK         Errno = iota // no error
+	ErrnoEOF                     // end of file
+	ErrnoNotExist                // file does not exist
+	ErrnoExist                   // file already exists
+	ErrnoPermission              // permission denied
+	ErrnoBadFD                   // invalid file descriptor
+	ErrnoInvalid                 // invalid argument
+	ErrnoIO                      // any other I/O error
+	ErrnoAgain                   // operation would block
+)
+
+var errnoText = [...]string{
+	ErrnoOK:         "no error",
+	ErrnoEOF:        "end of file",
+	ErrnoNotExist:   "file does not exist",
+	ErrnoExist:      "file already exists",
+	ErrnoPermission: "permission denied",
+	ErrnoBadFD:      "bad file descriptor",
+	ErrnoInvalid:    "invalid argument",
+	ErrnoIO:         "input/output error",
+	ErrnoAgain:      "operation would block",
+}
+
+func (e Errno) Error() string {
+	if e >= 0 && int(e) < len(errnoText) {
+		return errnoText[e]
+	}
+	return "errno " + strconv.Itoa(int(e))
+}
+
+// errnoOf returns the error code matching err.
+func errnoOf(err error) Errno {
+	var e Errno
+	switch {
+	case err == nil:
+		return ErrnoOK
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return ErrnoEOF
+	case errors.As(err, &e):
+		return e
+	case os.IsNotExist(err):
+		return ErrnoNotExist
+	case os.IsExist(err):
+		return ErrnoExist
+	case os.IsPermission(err):
+		return ErrnoPermission
+	case errors.Is(err, os.ErrClosed):
+		return ErrnoBadFD
+	case errors.Is(err, os.ErrInvalid):
+		return ErrnoInvalid
+	}
+	return ErrnoIO
+}
+
+// setErrno sets the error code returned by the next errno query from err. It
+// does nothing if err is nil.
+func (i *Instance) setErrno(err error) {
+	if err != nil {
+		i.errno = errnoOf(err)
+	}
+}
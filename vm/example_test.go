@@ -70,3 +70,40 @@ func ExampleBindOpcodeHandler() {
 	// Output:
 	// [1836311903]
 }
+
+// Demonstrates how to expose Go functions to guest programs with Bind. This
+// is the same fibonacci function as above, called through the bridge device.
+func ExampleBind() {
+	fib := func(v vm.Cell) vm.Cell {
+		var v0, v1 vm.Cell = 0, 1
+		for v > 1 {
+			v0, v1 = v1, v0+v1
+			v--
+		}
+		return v1
+	}
+
+	img, err := asm.Assemble("test_fib_bind", strings.NewReader(`
+		46 1	( argument and function number )
+		2 16 out 0 0 out wait 16 in	( call request on port 16 )
+		`))
+	if err != nil {
+		panic(err)
+	}
+
+	i, err := vm.New(img, "dummy", vm.Bind(16, "fib", fib))
+	if err != nil {
+		panic(err)
+	}
+
+	err = i.Run()
+	if err != nil {
+		panic(err)
+	}
+
+	// Fib(46) and the success flag.
+	fmt.Println(i.Data())
+
+	// Output:
+	// [1836311903 -1]
+}
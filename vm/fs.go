@@ -0,0 +1,367 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File is the interface implemented by files opened through a FS.
+type File interface {
+	fs.File
+	io.Writer
+	io.Seeker
+}
+
+// FS is the file system used for file I/O on port 4. It extends fs.FS with
+// write, directory and metadata operations that behave like their counterparts
+// in the os package.
+//
+// File names are passed as-is from the guest program. Implementations are free
+// to interpret them as they see fit.
+type FS interface {
+	fs.FS
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Remove(name string) error
+	Mkdir(name string, perm os.FileMode) error
+	Rename(oldname, newname string) error
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]fs.DirEntry, error)
+}
+
+// FileSystem configures the file system used for file I/O on port 4,
+// overriding the one provided by the Host.
+func FileSystem(fsys FS) Option {
+	return func(i *Instance) error {
+		i.fs = fsys
+		return nil
+	}
+}
+
+// jailPath converts a guest file name to a path relative to the root of a
+// jailed file system. Leading slashes and ".." elements that would go above the
+// root are removed.
+func jailPath(name string) string {
+	p := path.Clean("/" + name)[1:]
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+// memFS is an in-memory FS. Files and directories are indexed by their full
+// path as returned by jailPath.
+type memFS struct {
+	mu    sync.Mutex
+	clock Clock
+	files map[string]*memData
+}
+
+type memData struct {
+	name    string
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (d *memData) info() *memInfo {
+	return &memInfo{d.name, int64(len(d.data)), d.mode, d.modTime}
+}
+
+// NewMemFS returns a new, empty, in-memory FS. It is safe for concurrent use.
+// Guest file names are interpreted like with DirFS.
+//
+// The clock c is used to set file modification times. If c is nil,
+// modification times are always zero.
+func NewMemFS(c Clock) FS {
+	m := &memFS{clock: c, files: make(map[string]*memData)}
+	m.files["."] = &memData{name: ".", mode: os.ModeDir | 0777, modTime: m.now()}
+	return m
+}
+
+func (m *memFS) now() time.Time {
+	if m.clock == nil {
+		return time.Time{}
+	}
+	return m.clock.Now()
+}
+
+// create adds a new entry at path p. The parent directory must exist.
+func (m *memFS) create(p string, mode os.FileMode) (*memData, error) {
+	if d := m.files[path.Dir(p)]; d == nil {
+		return nil, fs.ErrNotExist
+	} else if !d.mode.IsDir() {
+		return nil, fs.ErrInvalid
+	}
+	d := &memData{name: path.Base(p), mode: mode, modTime: m.now()}
+	m.files[p] = d
+	return d, nil
+}
+
+// hasChildren returns true if the directory at path p is not empty.
+func (m *memFS) hasChildren(p string) bool {
+	for k := range m.files {
+		if k != "." && path.Dir(k) == p {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *memFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := jailPath(name)
+	d := m.files[p]
+	switch {
+	case d == nil && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case d != nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case d == nil:
+		var err error
+		if d, err = m.create(p, perm&os.ModePerm); err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+	case d.mode.IsDir() && flag&(os.O_WRONLY|os.O_RDWR) != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	case flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0:
+		d.data = nil
+		d.modTime = m.now()
+	}
+	return &memFile{fs: m, d: d, flag: flag}, nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := jailPath(name)
+	d := m.files[p]
+	switch {
+	case d == nil:
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	case p == ".":
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	case d.mode.IsDir() && m.hasChildren(p):
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrExist}
+	}
+	delete(m.files, p)
+	return nil
+}
+
+func (m *memFS) Mkdir(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := jailPath(name)
+	if m.files[p] != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	if _, err := m.create(p, os.ModeDir|perm&os.ModePerm); err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (m *memFS) Rename(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	op, np := jailPath(oldname), jailPath(newname)
+	d, nd := m.files[op], m.files[np]
+	var err error
+	switch {
+	case d == nil:
+		err = fs.ErrNotExist
+	case op == "." || np == "." || strings.HasPrefix(np, op+"/"):
+		err = fs.ErrInvalid
+	case op == np:
+		return nil
+	case nd != nil && nd.mode.IsDir() != d.mode.IsDir():
+		err = fs.ErrInvalid
+	case nd != nil && nd.mode.IsDir() && m.hasChildren(np):
+		err = fs.ErrExist
+	default:
+		if pd := m.files[path.Dir(np)]; pd == nil {
+			err = fs.ErrNotExist
+		} else if !pd.mode.IsDir() {
+			err = fs.ErrInvalid
+		}
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	for k, v := range m.files {
+		if k == op || strings.HasPrefix(k, op+"/") {
+			delete(m.files, k)
+			m.files[np+k[len(op):]] = v
+		}
+	}
+	d.name = path.Base(np)
+	return nil
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d := m.files[jailPath(name)]
+	if d == nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return d.info(), nil
+}
+
+func (m *memFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := jailPath(name)
+	d := m.files[p]
+	if d == nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	if !d.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	var l []fs.DirEntry
+	for k, v := range m.files {
+		if k != "." && path.Dir(k) == p {
+			l = append(l, fs.FileInfoToDirEntry(v.info()))
+		}
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Name() < l[j].Name() })
+	return l, nil
+}
+
+// memFile is an open file in a memFS.
+type memFile struct {
+	fs     *memFS
+	d      *memData
+	off    int64
+	flag   int
+	closed bool
+}
+
+func (f *memFile) check(op string, write bool) error {
+	if f.closed {
+		return &fs.PathError{Op: op, Path: f.d.name, Err: fs.ErrClosed}
+	}
+	if f.d.mode.IsDir() {
+		return &fs.PathError{Op: op, Path: f.d.name, Err: fs.ErrInvalid}
+	}
+	acc := f.flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+	if write && acc == os.O_RDONLY || !write && acc == os.O_WRONLY {
+		return &fs.PathError{Op: op, Path: f.d.name, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if f.off >= int64(len(f.d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.d.data[f.off:])
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.off = int64(len(f.d.data))
+	}
+	if end := f.off + int64(len(p)); end > int64(len(f.d.data)) {
+		f.d.data = append(f.d.data, make([]byte, end-int64(len(f.d.data)))...)
+	}
+	copy(f.d.data[f.off:], p)
+	f.off += int64(len(p))
+	f.d.modTime = f.fs.now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.d.name, Err: fs.ErrClosed}
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.d.data))
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.d.name, Err: fs.ErrInvalid}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.d.name, Err: fs.ErrClosed}
+	}
+	return f.d.info(), nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.d.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+// memInfo implements fs.FileInfo for memFS files.
+type memInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *memInfo) Name() string       { return fi.name }
+func (fi *memInfo) Size() int64        { return fi.size }
+func (fi *memInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *memInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,34 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !go1.25
+
+package vm
+
+import "github.com/pkg/errors"
+
+// DirFS returns a FS confined to the directory dir. Guest file names are
+// interpreted relative to dir, and "/" refers to dir itself. Guest programs
+// cannot access files outside of dir, either with ".." path elements or by
+// following symbolic links.
+//
+// The returned FS implements io.Closer.
+//
+// DirFS relies on os.Root and requires Go 1.25 or later. When built with an
+// older toolchain, it always returns an error.
+func DirFS(dir string) (FS, error) {
+	return nil, errors.Errorf("DirFS %s failed: requires Go 1.25 or later", dir)
+}
@@ -0,0 +1,82 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.25
+
+package vm
+
+import (
+	"io/fs"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+type dirFS struct {
+	root *os.Root
+}
+
+// DirFS returns a FS confined to the directory dir. Guest file names are
+// interpreted relative to dir, and "/" refers to dir itself. Guest programs
+// cannot access files outside of dir, either with ".." path elements or by
+// following symbolic links.
+//
+// The returned FS implements io.Closer.
+//
+// DirFS relies on os.Root and requires Go 1.25 or later. When built with an
+// older toolchain, it always returns an error.
+func DirFS(dir string) (FS, error) {
+	r, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "DirFS failed")
+	}
+	return &dirFS{r}, nil
+}
+
+func (d *dirFS) Open(name string) (fs.File, error) {
+	f, err := d.root.Open(jailPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (d *dirFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := d.root.OpenFile(jailPath(name), flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (d *dirFS) Remove(name string) error { return d.root.Remove(jailPath(name)) }
+func (d *dirFS) Close() error             { return d.root.Close() }
+
+func (d *dirFS) Mkdir(name string, perm os.FileMode) error {
+	return d.root.Mkdir(jailPath(name), perm)
+}
+
+func (d *dirFS) Rename(oldname, newname string) error {
+	return d.root.Rename(jailPath(oldname), jailPath(newname))
+}
+
+func (d *dirFS) Stat(name string) (os.FileInfo, error) {
+	return d.root.Stat(jailPath(name))
+}
+
+func (d *dirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(d.root.FS(), jailPath(name))
+}
@@ -0,0 +1,72 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.25
+
+package vm_test
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dobegor/ngaro/vm"
+)
+
+func TestDirFS(t *testing.T) {
+	dir := t.TempDir()
+	jail := filepath.Join(dir, "jail")
+	if err := os.Mkdir(jail, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(jail, "inside"), []byte("inside"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "secret"), filepath.Join(jail, "link")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	fsys, err := vm.DirFS(jail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fsys.(io.Closer).Close()
+
+	for _, name := range []string{"inside", "/inside", "a/../inside", "/../../inside"} {
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		assertEqual(t, "DirFS "+name, "inside", string(b))
+	}
+	for _, name := range []string{"../secret", "/../secret", "link", filepath.Join(dir, "secret")} {
+		if f, err := fsys.OpenFile(name, os.O_RDONLY, 0); err == nil {
+			f.Close()
+			t.Errorf("%s: escaped from jail", name)
+		}
+	}
+	if err = fsys.Remove("../secret"); err == nil {
+		t.Error("removed file outside of jail")
+	}
+	if _, err = os.Stat(filepath.Join(dir, "secret")); err != nil {
+		t.Error(err)
+	}
+}
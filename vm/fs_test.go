@@ -0,0 +1,108 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm_test
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"testing"
+
+	"github.com/dobegor/ngaro/vm"
+)
+
+func TestMemFS(t *testing.T) {
+	fsys := vm.NewMemFS(nil)
+	i, err := runAsmImage(`jump start
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:name .dat "/test.txt"
+		:start
+			lit name 1 -1 4 call io ( open for writing )
+			dup 'h' swap -3 4 call io drop
+			dup 'i' swap -3 4 call io drop
+			-4 4 call io drop
+			lit name 0 -1 4 call io ( open for reading )
+			dup -7 4 call io ( size )
+			swap dup -2 4 call io
+			swap dup -2 4 call io
+			swap -4 4 call io drop
+		`, "MemFS", vm.FileSystem(fsys), vm.StringCodec(testCodec{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "MemFS", "[2 104 105]", fmt.Sprint(i.Data()))
+
+	b, err := fs.ReadFile(fsys, "test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "MemFS ReadFile", "hi", string(b))
+
+	i, err = runAsmImage(`jump start
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:name .dat "test.txt"
+		:start
+			lit name -8 4 call io
+			lit name -8 4 call io
+			lit name 0 -1 4 call io
+		`, "MemFS", vm.FileSystem(fsys), vm.StringCodec(testCodec{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "MemFS delete", "[-1 0 0]", fmt.Sprint(i.Data()))
+}
+
+func TestMemFS_dirs(t *testing.T) {
+	fsys := vm.NewMemFS(nil)
+	for _, d := range []string{"a", "a/b"} {
+		if err := fsys.Mkdir(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fsys.Mkdir("x/y", 0777); !os.IsNotExist(err) {
+		t.Errorf("Mkdir without parent: %v", err)
+	}
+	f, err := fsys.OpenFile("a/b/f", os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err = fsys.Rename("a", "a/b/c"); err == nil {
+		t.Error("Rename into own subdirectory succeeded")
+	}
+	if err = fsys.Rename("a", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fsys.Stat("c/b/f"); err != nil {
+		t.Error(err)
+	}
+	if _, err = fsys.Stat("a/b/f"); !os.IsNotExist(err) {
+		t.Errorf("Stat of renamed file: %v", err)
+	}
+	if err = fsys.Remove("c"); !os.IsExist(err) {
+		t.Errorf("Remove of non-empty directory: %v", err)
+	}
+	l, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l) != 1 || l[0].Name() != "c" || !l[0].IsDir() {
+		t.Errorf("ReadDir: unexpected result %v", l)
+	}
+}
@@ -0,0 +1,190 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// Clock provides the current time to the VM. Sleep pauses the VM for the given
+// duration.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// Env provides access to environment variables.
+type Env interface {
+	Getenv(key string) string
+}
+
+// Host encapsulates all interactions of a VM instance with the outside world
+// that are not handled by the Terminal: the clock used for time queries, the
+// environment and the file system. The file system can be overridden
+// separately with the FileSystem option.
+//
+// Input returns the io.Reader to use as VM input, nil if none.
+type Host interface {
+	Clock
+	Env
+	FS
+	Input() io.Reader
+}
+
+// Delegate configures the Host used by the VM. The default is OSHost().
+//
+// If h.Input() is not nil, it is pushed on top of the input stack.
+func Delegate(h Host) Option {
+	return func(i *Instance) error {
+		i.clock, i.env, i.fs = h, h, h
+		if r := h.Input(); r != nil {
+			i.PushInput(r)
+		}
+		return nil
+	}
+}
+
+type osHost struct{}
+
+func (osHost) Now() time.Time           { return time.Now() }
+func (osHost) Sleep(d time.Duration)    { time.Sleep(d) }
+func (osHost) Getenv(key string) string { return os.Getenv(key) }
+func (osHost) Remove(name string) error { return os.Remove(name) }
+func (osHost) Input() io.Reader         { return nil }
+
+func (osHost) Mkdir(name string, perm os.FileMode) error  { return os.Mkdir(name, perm) }
+func (osHost) Rename(oldname, newname string) error       { return os.Rename(oldname, newname) }
+func (osHost) Stat(name string) (os.FileInfo, error)      { return os.Stat(name) }
+func (osHost) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(name) }
+func (osHost) Open(name string) (fs.File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+func (osHost) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// OSHost returns a Host that uses the real time, the process environment and
+// the host file system. Its Input method returns nil.
+func OSHost() Host {
+	return osHost{}
+}
+
+type detHost struct {
+	mu    sync.Mutex
+	now   time.Time
+	env   map[string]string
+	input []byte
+	fs    FS
+}
+
+func (h *detHost) Now() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.now
+}
+
+func (h *detHost) Sleep(d time.Duration) {
+	if d > 0 {
+		h.mu.Lock()
+		h.now = h.now.Add(d)
+		h.mu.Unlock()
+	}
+}
+
+func (h *detHost) Getenv(key string) string { return h.env[key] }
+
+func (h *detHost) Input() io.Reader {
+	if h.input == nil {
+		return nil
+	}
+	return bytes.NewReader(h.input)
+}
+
+func (h *detHost) Open(name string) (fs.File, error) {
+	if h.fs == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return h.fs.Open(name)
+}
+
+func (h *detHost) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if h.fs == nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return h.fs.OpenFile(name, flag, perm)
+}
+
+func (h *detHost) Remove(name string) error {
+	if h.fs == nil {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	return h.fs.Remove(name)
+}
+
+func (h *detHost) Mkdir(name string, perm os.FileMode) error {
+	if h.fs == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrNotExist}
+	}
+	return h.fs.Mkdir(name, perm)
+}
+
+func (h *detHost) Rename(oldname, newname string) error {
+	if h.fs == nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	return h.fs.Rename(oldname, newname)
+}
+
+func (h *detHost) Stat(name string) (os.FileInfo, error) {
+	if h.fs == nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return h.fs.Stat(name)
+}
+
+func (h *detHost) ReadDir(name string) ([]fs.DirEntry, error) {
+	if h.fs == nil {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	return h.fs.ReadDir(name)
+}
+
+// NewDeterministicHost returns a Host that does not depend on the state of the
+// machine it runs on. Given the same image and the same arguments, a VM
+// configured with such a Host always behaves exactly the same.
+//
+// The clock is frozen at the start time and only advances when Sleep is called:
+// sleeping returns immediately after advancing the clock. Environment variables are looked up
+// in env. The input data, if not nil, is returned as an io.Reader by Input.
+// File operations are delegated to fsys; if fsys is nil, they always fail as
+// if the requested file did not exist.
+func NewDeterministicHost(start time.Time, env map[string]string, input []byte, fsys FS) Host {
+	return &detHost{now: start, env: env, input: input, fs: fsys}
+}
@@ -0,0 +1,90 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/dobegor/ngaro/vm"
+	"github.com/pkg/errors"
+)
+
+// testCodec encodes strings with one byte per cell, zero terminated.
+type testCodec struct{}
+
+func (testCodec) Decode(mem []vm.Cell, start vm.Cell) []byte {
+	var b []byte
+	for ; mem[start] != 0; start++ {
+		b = append(b, byte(mem[start]))
+	}
+	return b
+}
+
+func (testCodec) Encode(mem []vm.Cell, start vm.Cell, s []byte) {
+	for _, c := range s {
+		mem[start] = vm.Cell(c)
+		start++
+	}
+	mem[start] = 0
+}
+
+var hostTest = `
+	jump start
+	.org 32
+	:io dup push out 0 0 out wait pop in ;
+	.org 64
+	:name .dat "HOME"
+	.org 80
+	:file .dat "some.file"
+	.org 96
+	:buf .dat 0 0 0 0 0 0 0 0 0 0
+	:start
+		-8 5 call io
+		lit buf lit name -10 5 call io drop
+		lit file 0 -1 4 call io
+		1 1 call io
+		1 1 call io
+		1 1 call io ( EOF )
+	`
+
+func TestDeterministicHost(t *testing.T) {
+	start := time.Date(2016, 11, 4, 12, 0, 0, 0, time.UTC)
+	run := func() *vm.Instance {
+		h := vm.NewDeterministicHost(start, map[string]string{"HOME": "/home/det"}, []byte("ok"), nil)
+		i, err := runAsmImage(hostTest, "DeterministicHost", vm.Delegate(h), vm.StringCodec(testCodec{}))
+		if errors.Cause(err) != io.EOF {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return i
+	}
+	i := run()
+	assertEqualI(t, "DeterministicHost 'k'", 'k', int(i.Pop()))
+	assertEqualI(t, "DeterministicHost 'o'", 'o', int(i.Pop()))
+	assertEqualI(t, "DeterministicHost fd", 0, int(i.Pop()))
+	assertEqualI(t, "DeterministicHost time", int(start.Unix()), int(i.Pop()))
+	assertEqual(t, "DeterministicHost env", "/home/det", string(testCodec{}.Decode(i.Mem, 96)))
+
+	j := run()
+	for n := range i.Mem {
+		if i.Mem[n] != j.Mem[n] {
+			t.Fatalf("DeterministicHost: memory differs at %d", n)
+		}
+	}
+	assertEqualI(t, "DeterministicHost insCount", int(i.InstructionCount()), int(j.InstructionCount()))
+}
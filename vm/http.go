@@ -0,0 +1,261 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// HTTPConfig configures the HTTP client device.
+//
+// Only requests to the listed hosts are allowed. Host names are matched
+// against either the host name or the "host:port" part of request URLs. If
+// Methods is empty, only GET and HEAD requests are allowed. Redirects to hosts
+// that are not allowed are not followed.
+type HTTPConfig struct {
+	Client  *http.Client // the client used for requests, http.DefaultClient if nil
+	Hosts   []string     // allowed hosts
+	Methods []string     // allowed methods
+}
+
+func (c *HTTPConfig) allowed(method string, u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	ok := len(c.Methods) == 0 && (method == "GET" || method == "HEAD")
+	for _, m := range c.Methods {
+		ok = ok || m == method
+	}
+	if !ok {
+		return false
+	}
+	for _, h := range c.Hosts {
+		if h == u.Host || h == u.Hostname() {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTPClient binds an HTTP client device to the given WAIT port. The suggested
+// port is 11. The following requests are supported (stack effects in
+// parentheses):
+//
+//	1  request ( method url headers body count -- hd )
+//	2  status  ( hd -- code )
+//	3  read    ( addr count hd -- n )
+//	4  header  ( dst name hd -- f )
+//	5  close   ( hd -- f )
+//
+// Request performs an HTTP request and returns a response descriptor, or 0 on
+// failure. The method, URL and headers are strings encoded with the configured
+// Codec. Headers are given as "Name: value" lines separated by newlines. If
+// there are no headers, the address of the headers string can be 0. The
+// request body is read from memory at address body, one byte per cell, and is
+// count bytes long.
+//
+// Status returns the status code of the response. Read reads at most count
+// bytes of the response body to memory at addr, one byte per cell, and returns
+// the number of bytes read, 0 at the end of the body. Header stores the value
+// of the named response header at dst and returns -1, or returns 0 if there is
+// no such header. Close returns 0 on success, 1 on failure.
+//
+// Errors are reported through the error code returned by port 4 request -11
+// (see Errno). Requests that are not allowed by cfg fail with ErrnoPermission.
+// Requests are also subject to the CapHTTP capability (see Policy).
+//
+// The response table belongs to the device. It is shared by clones of the
+// instance (see Clone).
+func HTTPClient(port Cell, cfg HTTPConfig) Option {
+	return func(i *Instance) error {
+		c := http.DefaultClient
+		if cfg.Client != nil {
+			c = cfg.Client
+		}
+		cl := *c
+		check := c.CheckRedirect
+		cl.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if !cfg.allowed(via[0].Method, req.URL) {
+				return errors.Errorf("redirect to %s not allowed", req.URL)
+			}
+			if check != nil {
+				return check(req, via)
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		}
+		cfg.Client = &cl
+		d := &httpDevice{cfg: cfg, resps: make(map[Cell]*http.Response), next: 1}
+		i.bindWaitHandler(port, d.wait)
+		return nil
+	}
+}
+
+type httpDevice struct {
+	cfg   HTTPConfig
+	mu    sync.Mutex
+	resps map[Cell]*http.Response
+	next  Cell
+}
+
+func (d *httpDevice) add(r *http.Response) Cell {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for ; d.resps[d.next] != nil; d.next++ {
+	}
+	d.resps[d.next] = r
+	return d.next
+}
+
+func (d *httpDevice) get(i *Instance, hd Cell) *http.Response {
+	d.mu.Lock()
+	r := d.resps[hd]
+	d.mu.Unlock()
+	if r == nil {
+		i.errno = ErrnoBadFD
+	}
+	return r
+}
+
+func (d *httpDevice) wait(i *Instance, v, port Cell) error {
+	i.errno = ErrnoOK
+	var r Cell
+	switch v {
+	case 1: // request
+		count, body, hdrs, u, m := i.Pop(), i.Pop(), i.Pop(), i.Pop(), i.Pop()
+		if i.sEnc == nil || !i.inMem(body, count) {
+			i.errno = ErrnoInvalid
+			break
+		}
+		method := string(i.sEnc.Decode(i.Mem, m))
+		rawURL, ok := i.guestName(CapHTTP, port, u)
+		if !ok {
+			break
+		}
+		var h string
+		if hdrs != 0 {
+			h = string(i.sEnc.Decode(i.Mem, hdrs))
+		}
+		b := cellsToBytes(i.Mem[body : body+count])
+		r, _ = i.devCall(func() (Cell, []Cell) {
+			req, err := http.NewRequest(method, rawURL, bytes.NewReader(b))
+			if err != nil {
+				i.errno = ErrnoInvalid
+				return 0, nil
+			}
+			if !d.cfg.allowed(req.Method, req.URL) {
+				i.errno = ErrnoPermission
+				return 0, nil
+			}
+			for _, l := range strings.Split(h, "\n") {
+				if k := strings.IndexByte(l, ':'); k > 0 {
+					req.Header.Add(strings.TrimSpace(l[:k]), strings.TrimSpace(l[k+1:]))
+				}
+			}
+			resp, err := d.cfg.Client.Do(req)
+			if err != nil {
+				i.setErrno(err)
+				return 0, nil
+			}
+			return d.add(resp), nil
+		})
+	case 2: // status
+		hd := i.Pop()
+		r, _ = i.devCall(func() (Cell, []Cell) {
+			if resp := d.get(i, hd); resp != nil {
+				return Cell(resp.StatusCode), nil
+			}
+			return 0, nil
+		})
+	case 3: // read
+		hd, count, addr := i.Pop(), i.Pop(), i.Pop()
+		if !i.inMem(addr, count) {
+			i.errno = ErrnoInvalid
+			break
+		}
+		var b []Cell
+		r, b = i.devCall(func() (Cell, []Cell) {
+			resp := d.get(i, hd)
+			if resp == nil {
+				return 0, nil
+			}
+			b := make([]byte, count)
+			n, err := io.ReadFull(resp.Body, b)
+			if n == 0 || err != io.ErrUnexpectedEOF {
+				i.setErrno(err)
+			}
+			return Cell(n), bytesToCells(b[:n])
+		})
+		i.UnshareMem()
+		copy(i.Mem[addr:], b)
+	case 4: // header
+		hd, name, dst := i.Pop(), i.Pop(), i.Pop()
+		if i.sEnc == nil {
+			i.errno = ErrnoInvalid
+			break
+		}
+		key := string(i.sEnc.Decode(i.Mem, name))
+		var b []Cell
+		r, b = i.devCall(func() (Cell, []Cell) {
+			resp := d.get(i, hd)
+			if resp == nil {
+				return 0, nil
+			}
+			vs, ok := resp.Header[http.CanonicalHeaderKey(key)]
+			if !ok {
+				return 0, nil
+			}
+			return -1, bytesToCells([]byte(strings.Join(vs, ", ")))
+		})
+		if r != 0 {
+			i.UnshareMem()
+			i.sEnc.Encode(i.Mem, dst, cellsToBytes(b))
+		}
+	case 5: // close
+		hd := i.Pop()
+		r, _ = i.devCall(func() (Cell, []Cell) {
+			resp := d.get(i, hd)
+			if resp == nil {
+				return 1, nil
+			}
+			d.mu.Lock()
+			delete(d.resps, hd)
+			if hd < d.next {
+				d.next = hd
+			}
+			d.mu.Unlock()
+			if err := resp.Body.Close(); err != nil {
+				i.setErrno(err)
+				return 1, nil
+			}
+			return 0, nil
+		})
+	default:
+		i.errno = ErrnoInvalid
+	}
+	i.WaitReply(r, port)
+	return nil
+}
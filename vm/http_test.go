@@ -0,0 +1,124 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dobegor/ngaro/asm"
+	"github.com/dobegor/ngaro/vm"
+)
+
+func TestHTTPClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://example.com/", http.StatusFound)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Method", r.Method)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s %s", r.Header.Get("X-Test"), b)
+	}))
+	defer srv.Close()
+
+	i, err := runAsmImage(fmt.Sprintf(`jump start
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:http 11 call io ;
+		:post .dat "POST"
+		:get .dat "GET"
+		:hdr .dat "X-Test: hello"
+		:xm .dat "x-method"
+		:body .dat "world"
+		:url .dat "%s/echo"
+		:redir .dat "%s/redirect"
+		:other .dat "http://example.com/"
+		.org 256
+		:buf
+		.org 288
+		:hval
+		.org 320
+		:hd .dat 0
+		:start
+			lit post lit url lit hdr lit body 5 1 call http lit hd !
+			lit hd @ 2 call http
+			lit buf 32 lit hd @ 3 call http
+			lit buf 32 lit hd @ 3 call http
+			lit hval lit xm lit hd @ 4 call http
+			lit hd @ 5 call http
+			lit post lit other 0 0 0 1 call http -11 4 call io
+			lit get lit redir 0 0 0 1 call http -11 4 call io
+		`, srv.URL, srv.URL), "HTTPClient",
+		vm.HTTPClient(11, vm.HTTPConfig{
+			Client:  srv.Client(),
+			Hosts:   []string{srv.Listener.Addr().String()},
+			Methods: []string{"GET", "POST"},
+		}),
+		vm.StringCodec(testCodec{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "HTTPClient", "[201 11 0 -1 0 0 4 0 7]", fmt.Sprint(i.Data()))
+	assertEqual(t, "HTTPClient body", "hello world", string(testCodec{}.Decode(i.Mem, 256)))
+	assertEqual(t, "HTTPClient header", "POST", string(testCodec{}.Decode(i.Mem, 288)))
+}
+
+func TestHTTPClient_clone(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	img, err := asm.Assemble("HTTPClient_clone", strings.NewReader(fmt.Sprintf(`jump start
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:http 11 call io ;
+		:get .dat "GET"
+		:url .dat "%s/"
+		:start
+			%s
+			-11 4 call io`, srv.URL, strings.Repeat("lit get lit url 0 0 0 1 call http 5 call http drop\n", 10))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := vm.New(img, "", vm.HTTPClient(11, vm.HTTPConfig{
+		Client: srv.Client(),
+		Hosts:  []string{srv.Listener.Addr().String()},
+	}), vm.StringCodec(testCodec{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// clones share the device and run concurrently
+	var wg sync.WaitGroup
+	for k := 0; k < 4; k++ {
+		c := i.Clone()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Run(); err != nil {
+				t.Error(err)
+			}
+			assertEqual(t, "HTTPClient_clone", "[0]", fmt.Sprint(c.Data()))
+		}()
+	}
+	wg.Wait()
+}
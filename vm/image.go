@@ -0,0 +1,589 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+var imageMagic = [8]byte{0x89, 'N', 'G', 'A', 'R', 'O', '\r', '\n'}
+
+const (
+	imageVersion  = 1
+	imageHdrSize  = 44
+	secData       = 1
+	secSymbols    = 2
+	secSourceMap  = 3
+	secChecksum   = 4
+	dataSectGap   = 64 // zero cells run that splits data sections
+	maxSymbolName = 1<<16 - 1
+)
+
+// ISA is a set of instruction set extensions required by an image.
+type ISA uint32
+
+// Instruction set extensions.
+const (
+	ISAFloat ISA = 1 << iota // floating point opcodes
+	ISACall                  // call opcode
+)
+
+// supportedISA returns the extensions supported by this VM.
+func supportedISA() ISA {
+	if unsafe.Sizeof(Cell(0)) < unsafe.Sizeof(FCell(0)) {
+		return ISACall
+	}
+	return ISAFloat | ISACall
+}
+
+// Symbol is a named value stored in an image file, usually a label or a
+// constant from the assembler source (see the asm package).
+type Symbol struct {
+	Name  string
+	Kind  uint8 // symbol kind, as defined by the producer of the image
+	Value Cell
+}
+
+// SourceLine maps Count cells starting at address Addr to a source line.
+type SourceLine struct {
+	Addr  int
+	Count int
+	Line  int
+}
+
+// Image is a memory image along with the metadata stored in image files.
+//
+// Image files written by SaveImage use a self-describing format. All integers are stored in the byte
+// order given in the header, which starts with:
+//
+//	offset	size	field
+//	0	8	magic "\x89NGARO\r\n"
+//	8	1	format version (1)
+//	9	1	cell width in bits (32 or 64)
+//	10	1	byte order (0: little endian, 1: big endian)
+//	11	1	reserved (0)
+//	12	4	required ISA extensions (see ISA)
+//	16	8	entry point
+//	24	8	memory size in cells
+//	32	4	data stack size (0 for the default)
+//	36	4	address stack size (0 for the default)
+//	40	4	section count
+//
+// The header is followed by sections, each made of a 4 bytes section type,
+// an 8 bytes payload length and the payload:
+//
+//	type	section		payload
+//	1	data		start address (one cell), then cells
+//	2	symbols		count (4 bytes), then for each symbol: kind (1 byte),
+//				value (8 bytes), name length (2 bytes), name
+//	3	source map	source name length (2 bytes), source name, count
+//				(4 bytes), then for each entry: address (8 bytes),
+//				cell count (4 bytes), line (4 bytes)
+//	4	checksum	CRC-32 (IEEE) of all the preceding bytes in the file
+//
+// Memory not covered by data sections is zeroed. Sections of unknown type are
+// skipped. A checksum section, if present, must be the last section.
+type Image struct {
+	Mem         []Cell
+	CellBits    int              // cell width in the image file; 0 for CellBits
+	ByteOrder   binary.ByteOrder // byte order of the image file; nil for little endian
+	Entry       int              // entry point
+	DataSize    int              // requested data stack size, 0 for the default
+	AddressSize int              // requested address stack size, 0 for the default
+	ISA         ISA              // required instruction set extensions
+	Symbols     []Symbol
+	Source      string       // name of the source file for SourceMap
+	SourceMap   []SourceLine // source lines, ordered by address or emission order
+	Checksum    bool         // write a checksum section; set on read if one was verified
+	Raw         bool         // image was loaded from a raw cell dump
+}
+
+// FromImage configures the VM to run img: the PC is set to the image's entry
+// point and the stack sizes are set if specified. It fails if the image
+// requires instruction set extensions that this VM does not support. The image
+// memory must be passed separately to New.
+func FromImage(img *Image) Option {
+	return func(i *Instance) error {
+		if u := img.ISA &^ supportedISA(); u != 0 {
+			return errors.Errorf("unsupported ISA extensions %#x", uint32(u))
+		}
+		i.PC = img.Entry
+		if img.DataSize > 0 {
+			if err := i.SetOptions(DataSize(img.DataSize)); err != nil {
+				return err
+			}
+		}
+		if img.AddressSize > 0 {
+			return i.SetOptions(AddressSize(img.AddressSize))
+		}
+		return nil
+	}
+}
+
+// encoder appends integers to a byte slice.
+type encoder struct {
+	b  []byte
+	bo binary.ByteOrder
+}
+
+func (e *encoder) u8(v uint8) { e.b = append(e.b, v) }
+
+func (e *encoder) u16(v uint16) {
+	var b [2]byte
+	e.bo.PutUint16(b[:], v)
+	e.b = append(e.b, b[:]...)
+}
+
+func (e *encoder) u32(v uint32) {
+	var b [4]byte
+	e.bo.PutUint32(b[:], v)
+	e.b = append(e.b, b[:]...)
+}
+
+func (e *encoder) u64(v uint64) {
+	var b [8]byte
+	e.bo.PutUint64(b[:], v)
+	e.b = append(e.b, b[:]...)
+}
+
+func (e *encoder) cell(v Cell, bits int) error {
+	if bits == 32 {
+		if Cell(int32(v)) != v {
+			return errors.Errorf("64 bits value %d too large", v)
+		}
+		e.u32(uint32(v))
+		return nil
+	}
+	e.u64(uint64(v))
+	return nil
+}
+
+// WriteImage writes img to w in the image file format.
+func WriteImage(w io.Writer, img *Image) error {
+	bo := img.ByteOrder
+	if bo == nil {
+		bo = binary.LittleEndian
+	}
+	bits := img.CellBits
+	if bits == 0 {
+		bits = CellBits
+	}
+	if bits != 32 && bits != 64 {
+		return errors.Errorf("saving to %d bits images is not supported", bits)
+	}
+	if img.Entry < 0 || img.Entry > len(img.Mem) {
+		return errors.Errorf("entry point %d out of memory range", img.Entry)
+	}
+
+	var secs [][]byte
+	section := func(typ uint32, payload []byte) {
+		e := encoder{make([]byte, 0, 12+len(payload)), bo}
+		e.u32(typ)
+		e.u64(uint64(len(payload)))
+		secs = append(secs, append(e.b, payload...))
+	}
+
+	mem := img.Mem
+	for start := 0; ; {
+		for start < len(mem) && mem[start] == 0 {
+			start++
+		}
+		if start == len(mem) {
+			break
+		}
+		end := start + 1
+		for k := end; k < len(mem) && k-end < dataSectGap; k++ {
+			if mem[k] != 0 {
+				end = k + 1
+			}
+		}
+		e := encoder{make([]byte, 0, (end-start+1)*bits/8), bo}
+		e.cell(Cell(start), bits)
+		for k, v := range mem[start:end] {
+			if err := e.cell(v, bits); err != nil {
+				return errors.Wrapf(err, "memory location %d", start+k)
+			}
+		}
+		section(secData, e.b)
+		start = end
+	}
+
+	if len(img.Symbols) > 0 {
+		e := encoder{nil, bo}
+		e.u32(uint32(len(img.Symbols)))
+		for _, s := range img.Symbols {
+			if len(s.Name) > maxSymbolName {
+				return errors.Errorf("symbol name too long: %.32s...", s.Name)
+			}
+			e.u8(s.Kind)
+			e.u64(uint64(s.Value))
+			e.u16(uint16(len(s.Name)))
+			e.b = append(e.b, s.Name...)
+		}
+		section(secSymbols, e.b)
+	}
+
+	if len(img.SourceMap) > 0 {
+		if len(img.Source) > maxSymbolName {
+			return errors.Errorf("source name too long: %.32s...", img.Source)
+		}
+		e := encoder{nil, bo}
+		e.u16(uint16(len(img.Source)))
+		e.b = append(e.b, img.Source...)
+		e.u32(uint32(len(img.SourceMap)))
+		for _, l := range img.SourceMap {
+			e.u64(uint64(l.Addr))
+			e.u32(uint32(l.Count))
+			e.u32(uint32(l.Line))
+		}
+		section(secSourceMap, e.b)
+	}
+
+	n := len(secs)
+	if img.Checksum {
+		n++
+	}
+	e := encoder{make([]byte, 0, imageHdrSize), bo}
+	e.b = append(e.b, imageMagic[:]...)
+	e.u8(imageVersion)
+	e.u8(uint8(bits))
+	if bo == binary.BigEndian {
+		e.u8(1)
+	} else {
+		e.u8(0)
+	}
+	e.u8(0)
+	e.u32(uint32(img.ISA))
+	e.u64(uint64(img.Entry))
+	e.u64(uint64(len(mem)))
+	e.u32(uint32(img.DataSize))
+	e.u32(uint32(img.AddressSize))
+	e.u32(uint32(n))
+
+	h := crc32.NewIEEE()
+	cw := io.MultiWriter(w, h)
+	if _, err := cw.Write(e.b); err != nil {
+		return errors.Wrap(err, "write failed")
+	}
+	for _, s := range secs {
+		if _, err := cw.Write(s); err != nil {
+			return errors.Wrap(err, "write failed")
+		}
+	}
+	if img.Checksum {
+		e = encoder{nil, bo}
+		sum := h.Sum32()
+		e.u32(secChecksum)
+		e.u64(4)
+		e.u32(sum)
+		if _, err := w.Write(e.b); err != nil {
+			return errors.Wrap(err, "write failed")
+		}
+	}
+	return nil
+}
+
+// decoder reads integers from an io.Reader. After the first error, all reads
+// return 0 and the error is kept in err. Since all reads are expected to
+// succeed, io.EOF is reported as io.ErrUnexpectedEOF.
+type decoder struct {
+	r   io.Reader
+	bo  binary.ByteOrder
+	b   [8]byte
+	err error
+}
+
+func (d *decoder) read(n int) []byte {
+	if d.err != nil {
+		return make([]byte, n)
+	}
+	if _, err := io.ReadFull(d.r, d.b[:n]); err != nil {
+		d.fail(err)
+		return make([]byte, n)
+	}
+	return d.b[:n]
+}
+
+func (d *decoder) fail(err error) {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	d.err = err
+}
+
+func (d *decoder) u8() uint8   { return d.read(1)[0] }
+func (d *decoder) u16() uint16 { return d.bo.Uint16(d.read(2)) }
+func (d *decoder) u32() uint32 { return d.bo.Uint32(d.read(4)) }
+func (d *decoder) u64() uint64 { return d.bo.Uint64(d.read(8)) }
+
+func (d *decoder) str(n int) string {
+	if d.err != nil {
+		return ""
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		d.fail(err)
+	}
+	return string(b)
+}
+
+func (d *decoder) cell(bits int) Cell {
+	if bits == 32 {
+		return Cell(int32(d.u32()))
+	}
+	v := int64(d.u64())
+	if c := Cell(v); int64(c) == v || d.err != nil {
+		return c
+	}
+	d.err = errors.Errorf("64 bits value %d too large", v)
+	return 0
+}
+
+// int converts v to an int, checking that it is in the range [0, max].
+func (d *decoder) int(v uint64, max int, what string) int {
+	if d.err == nil && v > uint64(max) {
+		d.err = errors.Errorf("%s %d out of range", what, v)
+		return 0
+	}
+	return int(v)
+}
+
+const maxInt = int(^uint(0) >> 1)
+
+// MaxImageCells is the largest memory or stack size, in cells, that ReadImage
+// accepts from an image header. It protects programs loading untrusted image
+// files from running out of memory; the default is 64Mi cells.
+var MaxImageCells = 1 << 26
+
+// grow extends mem with zeroed cells so that its length is at least n.
+func grow(mem []Cell, n int) []Cell {
+	if n > len(mem) {
+		mem = append(mem, make([]Cell, n-len(mem))...)
+	}
+	return mem
+}
+
+// ReadImage reads an image in the image file format from r. Memory is only
+// allocated as data sections are read, and the declared memory size must not
+// exceed MaxImageCells.
+func ReadImage(r io.Reader) (*Image, error) {
+	h := crc32.NewIEEE()
+	d := &decoder{r: io.TeeReader(r, h)}
+	var hdr [12]byte
+	if _, err := io.ReadFull(d.r, hdr[:]); err != nil {
+		return nil, errors.Wrap(err, "header read failed")
+	}
+	if !bytes.Equal(hdr[:8], imageMagic[:]) {
+		return nil, errors.New("not an image file")
+	}
+	if hdr[8] != imageVersion {
+		return nil, errors.Errorf("unsupported image format version %d", hdr[8])
+	}
+	img := &Image{CellBits: int(hdr[9])}
+	if img.CellBits != 32 && img.CellBits != 64 {
+		return nil, errors.Errorf("loading of %d bits images is not supported", img.CellBits)
+	}
+	switch hdr[10] {
+	case 0:
+		d.bo = binary.LittleEndian
+	case 1:
+		d.bo = binary.BigEndian
+	default:
+		return nil, errors.Errorf("invalid byte order %d", hdr[10])
+	}
+	img.ByteOrder = d.bo
+	img.ISA = ISA(d.u32())
+	entry := d.u64()
+	size := d.int(d.u64(), MaxImageCells, "memory size")
+	img.Entry = d.int(entry, size, "entry point")
+	img.DataSize = d.int(uint64(d.u32()), MaxImageCells, "data stack size")
+	img.AddressSize = d.int(uint64(d.u32()), MaxImageCells, "address stack size")
+	n := int(d.u32())
+	if d.err != nil {
+		return nil, errors.Wrap(d.err, "invalid header")
+	}
+
+	cellBytes := uint64(img.CellBits / 8)
+	for k := 0; k < n; k++ {
+		if img.Checksum {
+			return nil, errors.New("checksum is not the last section")
+		}
+		sum := h.Sum32()
+		typ := d.u32()
+		l := d.u64()
+		if d.err != nil {
+			return nil, errors.Wrap(d.err, "section read failed")
+		}
+		lr := &io.LimitedReader{R: d.r, N: int64(d.int(l, maxInt, "section length"))}
+		sd := &decoder{r: lr, bo: d.bo}
+		switch typ {
+		case secData:
+			if l < cellBytes || l%cellBytes != 0 {
+				return nil, errors.Errorf("invalid data section length %d", l)
+			}
+			start := sd.int(uint64(sd.cell(img.CellBits)), size, "data section address")
+			count := int(l/cellBytes) - 1
+			if sd.err == nil && count > size-start {
+				return nil, errors.Errorf("data section at %d overflows memory", start)
+			}
+			img.Mem = grow(img.Mem, start)
+			for p := start; p < start+count; p++ {
+				c := sd.cell(img.CellBits)
+				if sd.err != nil {
+					break
+				}
+				if p < len(img.Mem) {
+					img.Mem[p] = c
+				} else {
+					img.Mem = append(img.Mem, c)
+				}
+			}
+		case secSymbols:
+			cnt := int(sd.u32())
+			if uint64(cnt) > l/11 {
+				return nil, errors.Errorf("invalid symbol count %d", cnt)
+			}
+			for ; cnt > 0 && sd.err == nil; cnt-- {
+				var s Symbol
+				s.Kind = sd.u8()
+				s.Value = Cell(int64(sd.u64()))
+				s.Name = sd.str(int(sd.u16()))
+				img.Symbols = append(img.Symbols, s)
+			}
+		case secSourceMap:
+			img.Source = sd.str(int(sd.u16()))
+			cnt := int(sd.u32())
+			if uint64(cnt) > l/16 {
+				return nil, errors.Errorf("invalid source map count %d", cnt)
+			}
+			for ; cnt > 0 && sd.err == nil; cnt-- {
+				var s SourceLine
+				s.Addr = sd.int(sd.u64(), maxInt, "source map address")
+				s.Count = int(sd.u32())
+				s.Line = int(sd.u32())
+				img.SourceMap = append(img.SourceMap, s)
+			}
+		case secChecksum:
+			if v := sd.u32(); sd.err == nil && v != sum {
+				return nil, errors.New("checksum mismatch")
+			}
+			img.Checksum = true
+		default:
+			_, sd.err = io.Copy(io.Discard, lr)
+		}
+		if sd.err != nil {
+			return nil, errors.Wrap(sd.err, "section read failed")
+		}
+		if lr.N != 0 {
+			return nil, errors.Errorf("section type %d: %d extra bytes", typ, lr.N)
+		}
+	}
+	img.Mem = grow(img.Mem, size)
+	return img, nil
+}
+
+// LoadImage loads an image file. The format is detected automatically: if the
+// file is not in the image file format, it is loaded as a raw cell dump with
+// cellBits bits per cell, like Load does, and the Raw field of the returned
+// Image is set. The image memory is extended to minSize cells if smaller.
+func LoadImage(fileName string, minSize, cellBits int) (*Image, error) {
+	img, _, err := loadImage(fileName, minSize, cellBits)
+	return img, err
+}
+
+// loadImage implements LoadImage and also returns the number of cells in the
+// file.
+func loadImage(fileName string, minSize, cellBits int) (img *Image, fileCells int, err error) {
+	switch cellBits {
+	case 0:
+		cellBits = CellBits
+	case 32, 64:
+	default:
+		return nil, 0, errors.Errorf("loading of %d bits images is not supported", cellBits)
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "open failed")
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	if m, _ := br.Peek(len(imageMagic)); bytes.Equal(m, imageMagic[:]) {
+		if img, err = ReadImage(br); err != nil {
+			return nil, 0, errors.Wrap(err, "load failed")
+		}
+		fileCells = len(img.Mem)
+		if minSize > fileCells {
+			img.Mem = append(img.Mem, make([]Cell, minSize-fileCells)...)
+		}
+		return img, fileCells, nil
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "fstat failed")
+	}
+	sz := st.Size()
+	if sz > int64(maxInt) {
+		return nil, 0, errors.Errorf("%v: file too large", fileName)
+	}
+	fileCells = int(sz / int64(cellBits/8))
+	imgCells := fileCells
+	if minSize > imgCells {
+		imgCells = minSize
+	}
+	mem := make([]Cell, imgCells)
+	switch cellBits {
+	case 32:
+		err = load32(mem, br, fileCells)
+	case 64:
+		err = load64(mem, br, fileCells)
+	}
+	if err != nil {
+		return nil, fileCells, errors.Wrap(err, "load failed")
+	}
+	return &Image{Mem: mem, CellBits: cellBits, ByteOrder: binary.LittleEndian, Raw: true}, fileCells, nil
+}
+
+// SaveImage saves img to the file fileName in the image file format.
+func SaveImage(fileName string, img *Image) (err error) {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return errors.Wrap(err, "create failed")
+	}
+	w := bufio.NewWriter(f)
+	defer func() {
+		if e := w.Flush(); err == nil && e != nil {
+			err = errors.Wrap(e, "write failed")
+		}
+		if e := f.Close(); err == nil && e != nil {
+			err = errors.Wrap(e, "close failed")
+		}
+		// delete file on error
+		if err != nil {
+			os.Remove(fileName)
+		}
+	}()
+	return WriteImage(w, img)
+}
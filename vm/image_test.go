@@ -0,0 +1,236 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/dobegor/ngaro/asm"
+	"github.com/dobegor/ngaro/vm"
+)
+
+func TestImage_roundTrip(t *testing.T) {
+	mem := make([]vm.Cell, 300)
+	copy(mem, []vm.Cell{1, 42, 1, -1, 0, 1, 7})
+	mem[200] = 65
+	mem[299] = -2
+	for _, bits := range []int{32, 64} {
+		for _, bo := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			name := fmt.Sprintf("%d/%v", bits, bo)
+			img := &vm.Image{
+				Mem:         mem,
+				CellBits:    bits,
+				ByteOrder:   bo,
+				Entry:       5,
+				DataSize:    24,
+				AddressSize: 42,
+				ISA:         vm.ISACall,
+				Symbols:     []vm.Symbol{{"start", 0, 5}, {"MINUS", 1, -1}},
+				Source:      "test.asm",
+				SourceMap:   []vm.SourceLine{{0, 4, 1}, {5, 2, 3}},
+				Checksum:    true,
+			}
+			fn := filepath.Join(t.TempDir(), "image")
+			if err := vm.SaveImage(fn, img); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			got, err := vm.LoadImage(fn, 400, 32)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if len(got.Mem) != 400 || !reflect.DeepEqual(got.Mem[:300], mem) {
+				t.Errorf("%s: memory mismatch: %v", name, got.Mem)
+			}
+			got.Mem = mem
+			if !reflect.DeepEqual(got, img) {
+				t.Errorf("%s:\nExpected: %+v\n     Got: %+v", name, img, got)
+			}
+			if _, _, err = vm.Load(fn, 0, 0); err == nil {
+				t.Errorf("%s: expected Load to reject an image with an entry point", name)
+			}
+			img.Entry = 0
+			if err = vm.SaveImage(fn, img); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			m, cells, err := vm.Load(fn, 0, 0)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			assertEqualI(t, name, 300, cells)
+			assertEqualI(t, name, 300, len(m))
+		}
+	}
+}
+
+func TestImage_errors(t *testing.T) {
+	var b bytes.Buffer
+	img := &vm.Image{Mem: []vm.Cell{1, 2, 3}, Checksum: true}
+	if err := vm.WriteImage(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	data := b.Bytes()
+	if _, err := vm.ReadImage(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []struct {
+		name string
+		off  int
+		v    byte
+		err  string
+	}{
+		{"magic", 1, 'X', "not an image file"},
+		{"version", 8, 2, "unsupported image format version 2"},
+		{"bits", 9, 16, "loading of 16 bits images is not supported"},
+		{"entry", 16, 4, "invalid header: entry point 4 out of range"},
+		{"data", 70, 9, "checksum mismatch"},
+		{"length", 48, 0x28, "data section at 0 overflows memory"},
+	} {
+		c := append([]byte(nil), data...)
+		c[d.off] = d.v
+		_, err := vm.ReadImage(bytes.NewReader(c))
+		if err == nil || err.Error() != d.err {
+			t.Errorf("%s: expected error %q, got %v", d.name, d.err, err)
+		}
+	}
+	if _, err := vm.ReadImage(bytes.NewReader(data[:len(data)-2])); err == nil {
+		t.Error("truncated: expected error")
+	}
+	if unsafe.Sizeof(vm.Cell(0)) == 8 {
+		v := int64(1) << 40
+		img.Mem[1] = vm.Cell(v)
+		if err := vm.WriteImage(&b, &vm.Image{Mem: img.Mem, CellBits: 32}); err == nil {
+			t.Error("expected value too large error")
+		}
+	}
+}
+
+func TestImage_oversized(t *testing.T) {
+	var b bytes.Buffer
+	if err := vm.WriteImage(&b, &vm.Image{Mem: []vm.Cell{1, 2, 3}}); err != nil {
+		t.Fatal(err)
+	}
+	data := b.Bytes()
+
+	// header only, claiming a huge memory
+	hdr := append([]byte(nil), data[:44]...)
+	binary.LittleEndian.PutUint64(hdr[24:], 1<<40)
+	binary.LittleEndian.PutUint32(hdr[40:], 0)
+	_, err := vm.ReadImage(bytes.NewReader(hdr))
+	if exp := "invalid header: memory size 1099511627776 out of range"; err == nil || err.Error() != exp {
+		t.Errorf("Expected error %q, got %v", exp, err)
+	}
+
+	// huge stack sizes
+	copy(hdr, data)
+	binary.LittleEndian.PutUint32(hdr[32:], 1<<31)
+	_, err = vm.ReadImage(bytes.NewReader(hdr))
+	if exp := "invalid header: data stack size 2147483648 out of range"; err == nil || err.Error() != exp {
+		t.Errorf("Expected error %q, got %v", exp, err)
+	}
+	copy(hdr, data)
+	binary.LittleEndian.PutUint32(hdr[36:], 1<<31)
+	_, err = vm.ReadImage(bytes.NewReader(hdr))
+	if exp := "invalid header: address stack size 2147483648 out of range"; err == nil || err.Error() != exp {
+		t.Errorf("Expected error %q, got %v", exp, err)
+	}
+
+	// truncated data section claiming the whole memory
+	c := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint64(c[24:], uint64(vm.MaxImageCells))
+	binary.LittleEndian.PutUint64(c[48:], uint64(vm.MaxImageCells*8))
+	_, err = vm.ReadImage(bytes.NewReader(c))
+	if exp := "section read failed: unexpected EOF"; err == nil || err.Error() != exp {
+		t.Errorf("Expected error %q, got %v", exp, err)
+	}
+}
+
+func TestImage_raw(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "image")
+	if err := vm.Save(fn, []vm.Cell{1, -1}, 32); err != nil {
+		t.Fatal(err)
+	}
+	img, err := vm.LoadImage(fn, 0, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !img.Raw || img.CellBits != 32 || !reflect.DeepEqual(img.Mem, []vm.Cell{1, -1}) {
+		t.Fatalf("Unexpected image: %+v", img)
+	}
+}
+
+func TestImage_load(t *testing.T) {
+	// an image as written by ngasm, using the call instruction
+	mem, err := asm.Assemble("load", strings.NewReader(`
+		call double call double jump end
+		:double dup + ;
+		:end`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(t.TempDir(), "image")
+	img := &vm.Image{Mem: mem, CellBits: 32, ISA: vm.ISACall, Source: "load.asm", Checksum: true}
+	if err = vm.SaveImage(fn, img); err != nil {
+		t.Fatal(err)
+	}
+	m, _, err := vm.Load(fn, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := setup(m, C{3}, nil)
+	if err = i.Run(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "Load", "[12]", fmt.Sprint(i.Data()))
+
+	img.ISA = 1 << 8
+	if err = vm.SaveImage(fn, img); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = vm.Load(fn, 0, 0); err == nil {
+		t.Error("expected unsupported ISA error")
+	}
+}
+
+func TestFromImage(t *testing.T) {
+	mem, err := asm.Assemble("FromImage", strings.NewReader(`
+		42 bye
+		:start -16 5 out 0 0 out wait 5 in -17 5 out 0 0 out wait 5 in
+		.org 100 :bye`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := &vm.Image{Mem: mem, Entry: 3, DataSize: 24, AddressSize: 42}
+	i, err := runImage(mem, "FromImage", vm.FromImage(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqualI(t, "FromImage", 2, i.Depth())
+	assertEqualI(t, "FromImage", 42, int(i.Pop()))
+	assertEqualI(t, "FromImage", 24, int(i.Pop()))
+
+	img.ISA = 1 << 8
+	if _, err = vm.New(mem, "", vm.FromImage(img)); err == nil {
+		t.Fatal("expected unsupported ISA error")
+	}
+}
@@ -19,7 +19,6 @@ package vm
 import (
 	"io"
 	"os"
-	"time"
 	"unsafe"
 
 	"github.com/pkg/errors"
@@ -66,18 +65,146 @@ func (i *Instance) openfile(name string, mode Cell) Cell {
 	case 3:
 		flags = os.O_RDWR
 	default:
+		i.errno = ErrnoInvalid
 		return 0
 	}
-	f, err := os.OpenFile(name, flags, 0666)
+	f, err := i.openFile(name, flags, 0666)
 	if err != nil {
+		i.setErrno(err)
 		return 0
 	}
+	return i.newFD(f)
+}
+
+// inMem returns true if the n cells starting at addr are within memory bounds.
+func (i *Instance) inMem(addr, n Cell) bool {
+	return addr >= 0 && n >= 0 && int(addr) <= len(i.Mem) && int(n) <= len(i.Mem)-int(addr)
+}
+
+// bytesToCells converts a byte slice to cells, one byte per cell.
+func bytesToCells(b []byte) []Cell {
+	c := make([]Cell, len(b))
+	for k, v := range b {
+		c[k] = Cell(v)
+	}
+	return c
+}
+
+// cellsToBytes converts cells to a byte slice, keeping the low byte of each
+// cell.
+func cellsToBytes(c []Cell) []byte {
+	b := make([]byte, len(c))
+	for k, v := range c {
+		b[k] = byte(v)
+	}
+	return b
+}
+
+// newFD allocates a new file descriptor for f.
+func (i *Instance) newFD(f File) Cell {
 	for ; i.files[i.fid] != nil; i.fid++ {
 	}
 	i.files[i.fid] = f
 	return i.fid
 }
 
+// guestName decodes a name from memory for a request on the given port that
+// requires the capability c. It returns false and sets errno if no Codec is
+// configured or if the request is denied.
+func (i *Instance) guestName(c Capability, port, addr Cell) (string, bool) {
+	if i.sEnc == nil {
+		i.errno = ErrnoInvalid
+		return "", false
+	}
+	name := string(i.sEnc.Decode(i.Mem, addr))
+	if !i.allow(c, port, name, 0) {
+		i.errno = ErrnoPermission
+		return "", false
+	}
+	return name, true
+}
+
+// statMode converts m to a Unix style file mode.
+func statMode(m os.FileMode) Cell {
+	r := Cell(m.Perm())
+	switch {
+	case m.IsDir():
+		r |= 0040000
+	case m.IsRegular():
+		r |= 0100000
+	}
+	return r
+}
+
+// dirFile is the File associated with directory descriptors. Directory entries
+// are read when the directory is opened.
+type dirFile struct {
+	names []string
+	pos   int
+}
+
+func (d *dirFile) Read([]byte) (int, error)       { return 0, ErrnoInvalid }
+func (d *dirFile) Write([]byte) (int, error)      { return 0, ErrnoInvalid }
+func (d *dirFile) Seek(int64, int) (int64, error) { return 0, ErrnoInvalid }
+func (d *dirFile) Stat() (os.FileInfo, error)     { return nil, ErrnoInvalid }
+func (d *dirFile) Close() error                   { return nil }
+
+// file returns the file with the given descriptor. If there is no such file,
+// it sets errno to ErrnoBadFD and returns nil.
+func (i *Instance) file(fd Cell) File {
+	f := i.files[fd]
+	if f == nil {
+		i.errno = ErrnoBadFD
+	}
+	return f
+}
+
+// blockIO transfers count bytes between the file f and the memory range
+// starting at addr. If pack is 0, bytes are stored one per cell. If pack is 1,
+// they are packed 8 per cell in little-endian order. It returns the number of
+// bytes transferred or -1 if any argument is invalid. File errors are reported
+// through errno.
+func (i *Instance) blockIO(write bool, f File, addr, count, pack Cell) Cell {
+	var per int
+	switch pack {
+	case 0:
+		per = 1
+	case 1:
+		per = 8
+	default:
+		i.errno = ErrnoInvalid
+		return -1
+	}
+	if f == nil {
+		return -1
+	}
+	if count < 0 || !i.inMem(addr, (count+Cell(per)-1)/Cell(per)) {
+		i.errno = ErrnoInvalid
+		return -1
+	}
+	buf := make([]byte, count)
+	if write {
+		mem := i.Mem[addr:]
+		for k := range buf {
+			buf[k] = byte(mem[k/per] >> uint(8*(k%per)))
+		}
+		n, err := f.Write(buf)
+		i.setErrno(err)
+		return Cell(n)
+	}
+	n, err := io.ReadFull(f, buf)
+	i.setErrno(err)
+	i.UnshareMem()
+	mem := i.Mem[addr : int(addr)+(n+per-1)/per]
+	for k := range mem {
+		mem[k] = 0
+	}
+	for k, b := range buf[:n] {
+		mem[k/per] |= Cell(b) << uint(8*(k%per))
+	}
+	return Cell(n)
+}
+
 // PushInput sets r as the current input io.Reader for the VM. When this reader
 // reaches EOF, the previously pushed reader will be used.
 func (i *Instance) PushInput(r io.Reader) {
@@ -123,15 +250,46 @@ func (i *Instance) WaitReply(v, port Cell) {
 
 // Wait is the default WAIT handler bound to ports 1, 2, 4, 5 and 8. It can be
 // called manually by custom handlers that override default behaviour.
+//
+// In addition to the file operations defined in the Ngaro specification, port
+// 4 supports the following requests (stack effects in parentheses):
+//
+//	-9   block read  ( addr count packing fd -- n )
+//	-10  block write ( addr count packing fd -- n )
+//	-11  last error  ( -- errno )
+//	-12  open dir    ( name -- fd )
+//	-13  read dir    ( dst fd -- f )
+//	-14  mkdir       ( name -- f )
+//	-15  rmdir       ( name -- f )
+//	-16  rename      ( old new -- f )
+//	-17  stat        ( dst name -- f )
+//	-18  exists      ( name -- f )
+//
+// Block operations transfer count bytes between a file and memory starting at
+// addr. With a packing of 0, each cell holds one byte. With a packing of 1, each
+// cell holds 8 bytes in little-endian order. The number of bytes transferred is
+// returned, or -1 if the arguments are invalid.
+//
+// Open dir returns a descriptor from which directory entries can be read one at
+// a time with read dir, and that must be closed with request -4. Read dir
+// stores the name of the next entry at dst and returns -1, or returns 0 once
+// all entries have been read. Stat stores the size, Unix style mode and
+// modification time (in seconds since the Unix epoch) of the file in three
+// consecutive cells starting at dst. Other requests return -1 on success and 0
+// on failure. All names are encoded with the configured Codec.
+//
+// Every file operation sets the error code returned by request -11 (see
+// Errno). Since a read byte request returns 0 at end of file, the error code
+// must be checked to tell it apart from a 0 byte.
 func (i *Instance) Wait(v, port Cell) error {
 	switch port {
 	case 1: // input
 		if v == 1 {
 			var b [1]byte
-			if i.input == nil {
+			if i.input == nil && i.tape == nil {
 				return io.EOF
 			}
-			size, err := i.input.Read(b[:])
+			size, err := i.readInput(b[:])
 			if size > 0 {
 				i.WaitReply(Cell(b[0]), 1)
 			} else {
@@ -160,8 +318,16 @@ func (i *Instance) Wait(v, port Cell) error {
 	case 4: // FileIO
 		if v != 0 {
 			var b [1]byte
+			if v != -11 {
+				i.errno = ErrnoOK
+			}
 			switch v {
 			case 1: // save image
+				if !i.allow(CapSaveImage, 4, i.imageFile, 0) {
+					i.errno = ErrnoPermission
+					i.WaitReply(-1, 4)
+					break
+				}
 				err := i.memDump(i.imageFile, i.Mem)
 				if err != nil {
 					return errors.Wrap(err, "image dump failed")
@@ -170,12 +336,18 @@ func (i *Instance) Wait(v, port Cell) error {
 			case 2: // include file
 				i.WaitReply(0, 4)
 				var (
-					f    *os.File
+					f    File
 					err  error
 					addr = i.Pop()
 				)
 				if i.sEnc != nil {
-					f, err = os.Open(string(i.sEnc.Decode(i.Mem, addr)))
+					name := string(i.sEnc.Decode(i.Mem, addr))
+					if !i.allow(CapInclude, 4, name, 0) {
+						i.errno = ErrnoPermission
+						i.WaitReply(-1, 4)
+						break
+					}
+					f, err = i.fsOpen(name, os.O_RDONLY, 0)
 					if err != nil {
 						return errors.Wrap(err, "file include failed")
 					}
@@ -186,68 +358,202 @@ func (i *Instance) Wait(v, port Cell) error {
 			case -1: // open file
 				var fd Cell
 				if i.sEnc != nil {
-					fd = i.openfile(string(i.sEnc.Decode(i.Mem, i.data[i.sp])), i.tos)
+					name := string(i.sEnc.Decode(i.Mem, i.data[i.sp]))
+					if i.allow(CapOpen, 4, name, i.tos) {
+						fd = i.openfile(name, i.tos)
+					} else {
+						i.errno = ErrnoPermission
+					}
+				} else {
+					i.errno = ErrnoInvalid
 				}
 				i.Drop2()
 				i.WaitReply(fd, 4)
 			case -2: // read byte
-				f := i.files[i.Pop()]
-				if f != nil {
-					f.Read(b[:])
+				if f := i.file(i.Pop()); f != nil {
+					if n, err := f.Read(b[:]); n == 0 {
+						i.setErrno(err)
+					}
 				}
 				i.WaitReply(Cell(b[0]), 4)
 			case -3: // write byte
 				var l int
 				b[0] = byte(i.data[i.sp])
-				f := i.files[i.tos]
+				f := i.file(i.tos)
 				i.Drop2()
 				if f != nil {
-					l, _ = f.Write(b[:])
+					var err error
+					l, err = f.Write(b[:])
+					i.setErrno(err)
 				}
 				i.WaitReply(Cell(l), 4)
 			case -4: // close fd
 				var ret Cell = 1
 				id := i.Pop()
-				if f := i.files[id]; f != nil {
-					if err := f.Close(); err == nil {
+				if f := i.file(id); f != nil {
+					err := f.Close()
+					if err == nil {
 						i.files[id] = nil
 						i.fid = id
 						ret = 0
 					}
+					i.setErrno(err)
 				}
 				i.WaitReply(ret, 4)
 			case -5: // ftell
 				var p int64
-				if f := i.files[i.Pop()]; f != nil {
-					p, _ = f.Seek(0, 1)
+				if f := i.file(i.Pop()); f != nil {
+					var err error
+					p, err = f.Seek(0, 1)
+					i.setErrno(err)
 				}
 				i.WaitReply(Cell(p), 4)
 			case -6: // seek
 				var p int64
-				o, f := i.data[i.sp], i.files[i.tos]
+				o, f := i.data[i.sp], i.file(i.tos)
 				i.Drop2()
 				if f != nil {
-					p, _ = f.Seek(int64(o), os.SEEK_SET)
+					var err error
+					p, err = f.Seek(int64(o), os.SEEK_SET)
+					i.setErrno(err)
 				}
 				i.WaitReply(Cell(p), 4)
 			case -7: // file size
 				var sz Cell
-				if f := i.files[i.Pop()]; f != nil {
-					if fi, err := f.Stat(); err == nil {
+				if f := i.file(i.Pop()); f != nil {
+					fi, err := f.Stat()
+					if err == nil {
 						sz = Cell(fi.Size())
 					}
+					i.setErrno(err)
 				}
 				i.WaitReply(sz, 4)
 			case -8: // delete
 				var r Cell
 				addr := i.Pop()
 				if i.sEnc != nil {
-					if os.Remove(string(i.sEnc.Decode(i.Mem, addr))) == nil {
+					name := string(i.sEnc.Decode(i.Mem, addr))
+					if i.allow(CapDelete, 4, name, 0) {
+						err := i.removeFile(name)
+						if err == nil {
+							r = -1
+						}
+						i.setErrno(err)
+					} else {
+						i.errno = ErrnoPermission
+					}
+				} else {
+					i.errno = ErrnoInvalid
+				}
+				i.WaitReply(r, 4)
+			case -9, -10: // block read / write
+				fd, pack, cnt, addr := i.Pop(), i.Pop(), i.Pop(), i.Pop()
+				i.WaitReply(i.blockIO(v == -10, i.file(fd), addr, cnt, pack), 4)
+			case -11: // last error
+				i.WaitReply(Cell(i.errno), 4)
+			case -12: // open directory
+				var fd Cell
+				if name, ok := i.guestName(CapStat, 4, i.Pop()); ok {
+					names, err := i.readDir(name)
+					if err == nil {
+						fd = i.newFD(&dirFile{names: names})
+					}
+					i.setErrno(err)
+				}
+				i.WaitReply(fd, 4)
+			case -13: // read directory
+				var r Cell
+				fd, dst := i.Pop(), i.Pop()
+				d, _ := i.file(fd).(*dirFile)
+				switch {
+				case d == nil:
+					i.errno = ErrnoBadFD
+				case i.sEnc == nil:
+					i.errno = ErrnoInvalid
+				case d.pos >= len(d.names):
+					i.errno = ErrnoEOF
+				default:
+					i.UnshareMem()
+					i.sEnc.Encode(i.Mem, dst, []byte(d.names[d.pos]))
+					d.pos++
+					r = -1
+				}
+				i.WaitReply(r, 4)
+			case -14: // make directory
+				var r Cell
+				if name, ok := i.guestName(CapMkdir, 4, i.Pop()); ok {
+					err := i.mkdir(name, 0777)
+					if err == nil {
+						r = -1
+					}
+					i.setErrno(err)
+				}
+				i.WaitReply(r, 4)
+			case -15: // remove directory
+				var r Cell
+				if name, ok := i.guestName(CapDelete, 4, i.Pop()); ok {
+					fi, err := i.stat(name)
+					if err == nil && !fi.IsDir() {
+						err = ErrnoInvalid
+					}
+					if err == nil {
+						err = i.removeFile(name)
+					}
+					if err == nil {
+						r = -1
+					}
+					i.setErrno(err)
+				}
+				i.WaitReply(r, 4)
+			case -16: // rename
+				var r Cell
+				newAddr, oldAddr := i.Pop(), i.Pop()
+				if i.sEnc == nil {
+					i.errno = ErrnoInvalid
+				} else {
+					oldName := string(i.sEnc.Decode(i.Mem, oldAddr))
+					newName := string(i.sEnc.Decode(i.Mem, newAddr))
+					if i.policy == nil || i.policy(i, Request{Cap: CapRename, Port: 4, Name: oldName, NewName: newName}) {
+						err := i.rename(oldName, newName)
+						if err == nil {
+							r = -1
+						}
+						i.setErrno(err)
+					} else {
+						i.errno = ErrnoPermission
+					}
+				}
+				i.WaitReply(r, 4)
+			case -17: // stat
+				var r Cell
+				addr, dst := i.Pop(), i.Pop()
+				if name, ok := i.guestName(CapStat, 4, addr); ok {
+					if dst < 0 || int(dst) > len(i.Mem)-3 {
+						i.errno = ErrnoInvalid
+					} else if fi, err := i.stat(name); err != nil {
+						i.setErrno(err)
+					} else {
+						i.UnshareMem()
+						i.Mem[dst] = Cell(fi.Size())
+						i.Mem[dst+1] = statMode(fi.Mode())
+						i.Mem[dst+2] = Cell(fi.ModTime().Unix())
 						r = -1
 					}
 				}
 				i.WaitReply(r, 4)
+			case -18: // exists
+				var r Cell
+				if name, ok := i.guestName(CapStat, 4, i.Pop()); ok {
+					_, err := i.stat(name)
+					if err == nil {
+						r = -1
+					} else if !os.IsNotExist(err) {
+						i.setErrno(err)
+					}
+				}
+				i.WaitReply(r, 4)
 			default:
+				i.errno = ErrnoInvalid
 				i.WaitReply(0, 4)
 			}
 		}
@@ -257,19 +563,25 @@ func (i *Instance) Wait(v, port Cell) error {
 			case -1:
 				// image size
 				i.Ports[5] = Cell(len(i.Mem))
-			// -2, -3, -4: canvas related
+			case -2, -3, -4, -7:
+				// canvas enabled, width and height (see Canvas), mouse
+				// enabled (see Mouse)
+				i.Ports[5] = i.devCaps[i.Ports[5]]
 			case -5:
 				// data depth
 				i.Ports[5] = Cell(i.Depth())
 			case -6:
 				// address depth
 				i.Ports[5] = Cell(i.rsp)
-			// -7: mouse enabled
 			case -8:
 				// unix time
-				i.Ports[5] = Cell(time.Now().Unix())
+				i.Ports[5] = Cell(i.now().Unix())
 			case -9:
 				// exit VM
+				if !i.allow(CapExit, 5, "", 0) {
+					i.Ports[5] = -1
+					break
+				}
 				i.Ports[5] = 0
 				i.PC = len(i.Mem) - 1 // will be incremented when returning
 			case -10:
@@ -277,25 +589,22 @@ func (i *Instance) Wait(v, port Cell) error {
 				src, dst := i.tos, i.data[i.sp]
 				i.Drop2()
 				if i.sEnc != nil {
-					i.sEnc.Encode(i.Mem, dst, []byte(os.Getenv(string(i.sEnc.Decode(i.Mem, src)))))
+					var val string
+					if name := string(i.sEnc.Decode(i.Mem, src)); i.allow(CapEnv, 5, name, 0) {
+						val = i.getenv(name)
+					}
+					i.UnshareMem()
+					i.sEnc.Encode(i.Mem, dst, []byte(val))
 				}
 				i.Ports[5] = 0
 			case -11:
 				// console width
-				if i.output != nil {
-					w, _ := i.output.Size()
-					i.Ports[5] = Cell(w)
-				} else {
-					i.Ports[5] = 0
-				}
+				w, _ := i.consoleSize()
+				i.Ports[5] = Cell(w)
 			case -12:
 				// console height
-				if i.output != nil {
-					_, h := i.output.Size()
-					i.Ports[5] = Cell(h)
-				} else {
-					i.Ports[5] = 0
-				}
+				_, h := i.consoleSize()
+				i.Ports[5] = Cell(h)
 			case -13:
 				i.Ports[5] = CellBits
 			case -14:
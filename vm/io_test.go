@@ -18,10 +18,14 @@ package vm_test
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"strings"
 	"testing"
+	"time"
 	"unsafe"
 
 	"github.com/dobegor/ngaro/asm"
@@ -230,3 +234,131 @@ func TestSave_32(t *testing.T) {
 		t.Fatalf("Save image error:\nexpected %v, got %v", img, saved[:cells])
 	}
 }
+
+func Test_io_Block(t *testing.T) {
+	fsys := vm.NewMemFS(nil)
+	f, err := fsys.OpenFile("data", os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("Hello, World!"))
+	f.Close()
+
+	i, err := runAsmImage(`jump start
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:name .dat "data"
+		:out .dat "out"
+		.org 48
+		:fd .dat 0
+		.org 64
+		:buf
+		.org 96
+		:pbuf
+		.org 128
+		:start
+			lit name 0 -1 4 call io lit fd !
+			lit buf 13 0 lit fd @ -9 4 call io
+			0 lit fd @ -6 4 call io drop
+			lit pbuf 16 1 lit fd @ -9 4 call io
+			lit buf 1 0 lit fd @ -9 4 call io ( EOF )
+			lit buf 1 2 lit fd @ -9 4 call io ( bad packing )
+			lit buf 1 0 42 -9 4 call io ( bad fd )
+			lit fd @ -4 4 call io drop
+			lit out 1 -1 4 call io lit fd !
+			lit pbuf 13 1 lit fd @ -10 4 call io
+			lit fd @ -4 4 call io drop
+		`, "io_Block", vm.FileSystem(fsys), vm.StringCodec(testCodec{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_Block results", "[13 13 0 -1 -1 13]", fmt.Sprint(i.Data()))
+	assertEqual(t, "io_Block unpacked", "Hello, World!", string(testCodec{}.Decode(i.Mem, 64)))
+	assertEqualI(t, "io_Block packed", int(binary.LittleEndian.Uint64([]byte("Hello, W"))), int(i.Mem[96]))
+	assertEqualI(t, "io_Block packed", int(binary.LittleEndian.Uint64([]byte("orld!\x00\x00\x00"))), int(i.Mem[97]))
+	b, err := fs.ReadFile(fsys, "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_Block write", "Hello, World!", string(b))
+}
+
+func Test_io_Errno(t *testing.T) {
+	fsys := vm.NewMemFS(nil)
+	f, err := fsys.OpenFile("a", os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0})
+	f.Close()
+
+	i, err := runAsmImage(`jump start
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:errno -11 4 call io ;
+		:a .dat "a"
+		:b .dat "b"
+		:fd .dat 0
+		.org 64
+		:start
+			lit b 0 -1 4 call io call errno ( not found )
+			42 -2 4 call io call errno ( bad fd )
+			lit a 7 -1 4 call io call errno ( bad mode )
+			lit a 0 -1 4 call io lit fd !
+			lit fd @ -2 4 call io call errno ( 0 byte )
+			lit fd @ -2 4 call io call errno ( EOF )
+			'x' lit fd @ -3 4 call io call errno ( read only )
+			lit fd @ -4 4 call io call errno
+			lit b -8 4 call io call errno
+			-99 4 call io drop call errno call errno
+		`, "io_Errno", vm.FileSystem(fsys), vm.StringCodec(testCodec{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_Errno", "[0 2 0 5 0 6 0 0 0 1 0 4 0 0 0 2 6 6]", fmt.Sprint(i.Data()))
+}
+
+func Test_io_Dir(t *testing.T) {
+	start := time.Date(2016, 11, 4, 12, 0, 0, 0, time.UTC)
+	fsys := vm.NewMemFS(vm.NewDeterministicHost(start, nil, nil, nil))
+	i, err := runAsmImage(`jump start
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:errno -11 4 call io ;
+		:d .dat "d"
+		:da .dat "d/a"
+		:db .dat "d/b"
+		:dc .dat "/d/c"
+		:fd .dat 0
+		.org 80
+		:n1 .org 88
+		:n2 .org 96
+		:st .dat 0 0 0
+		.org 112
+		:start
+			lit d -14 4 call io
+			lit da 1 -1 4 call io lit fd !
+			'x' lit fd @ -3 4 call io drop
+			lit fd @ -4 4 call io drop
+			lit db 1 -1 4 call io -4 4 call io drop
+			lit d -12 4 call io lit fd !
+			lit n1 lit fd @ -13 4 call io
+			lit n2 lit fd @ -13 4 call io
+			lit n2 lit fd @ -13 4 call io call errno ( EOF )
+			lit fd @ -4 4 call io drop
+			lit da lit dc -16 4 call io
+			lit st lit dc -17 4 call io
+			lit da -18 4 call io
+			lit d -15 4 call io call errno ( not empty )
+			lit dc -15 4 call io call errno ( not a directory )
+			lit dc -8 4 call io drop lit db -8 4 call io drop
+			lit d -15 4 call io
+			lit d -18 4 call io
+		`, "io_Dir", vm.FileSystem(fsys), vm.StringCodec(testCodec{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "io_Dir", "[-1 -1 -1 0 1 -1 -1 0 0 3 0 6 -1 0]", fmt.Sprint(i.Data()))
+	assertEqual(t, "io_Dir readdir", "a b", string(testCodec{}.Decode(i.Mem, 80))+" "+string(testCodec{}.Decode(i.Mem, 88)))
+	assertEqual(t, "io_Dir stat", fmt.Sprint([]vm.Cell{1, 0100666, vm.Cell(start.Unix())}), fmt.Sprint(i.Mem[96:99]))
+}
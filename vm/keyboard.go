@@ -0,0 +1,133 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import "sync"
+
+// Key codes for special keys reported by the keyboard device. Other keys are
+// reported as their Unicode code point. Enter, Tab, Backspace and Escape are
+// reported as 13, 9, 127 and 27.
+const (
+	KeyUp Cell = -1 - iota
+	KeyDown
+	KeyRight
+	KeyLeft
+	KeyHome
+	KeyEnd
+	KeyInsert
+	KeyDelete
+	KeyPageUp
+	KeyPageDown
+	KeyF1
+	KeyF2
+	KeyF3
+	KeyF4
+	KeyF5
+	KeyF6
+	KeyF7
+	KeyF8
+	KeyF9
+	KeyF10
+	KeyF11
+	KeyF12
+)
+
+// Key modifier bits reported by the keyboard device.
+const (
+	ModShift Cell = 1 << iota
+	ModAlt
+	ModCtrl
+)
+
+// Keyboard binds a keyboard device to the given WAIT port. The suggested port is
+// 14. Key events are fed by the host with KeyEvent and queued until read by the
+// guest. The following requests are supported (stack effects in parentheses):
+//
+//	1  available ( -- n )
+//	2  read      ( -- key mods )
+//	3  poll      ( -- key mods )
+//
+// Available returns the number of queued key events; it never blocks. Read
+// waits until a key event is available and removes it from the queue. Poll
+// behaves like read but returns 0 0 instead of waiting if the queue is empty.
+//
+// Keys are reported as Unicode code points or one of the Key* constants. Control
+// characters other than Enter, Tab, Backspace and Escape are reported as the
+// corresponding lower case letter with the ModCtrl modifier.
+//
+// A Stop request does not interrupt a pending read request; it takes effect
+// once the next key event is received. The key queue belongs to the device and
+// is shared by clones of the instance (see Clone).
+func Keyboard(port Cell) Option {
+	return func(i *Instance) error {
+		k := &keyboard{}
+		k.cond.L = &k.mu
+		i.keyboard = k
+		i.bindWaitHandler(port, k.wait)
+		return nil
+	}
+}
+
+// KeyEvent queues a key event for the keyboard device. It does nothing if the
+// keyboard device is not enabled (see Keyboard).
+//
+// KeyEvent is safe for concurrent use and can be called while the VM is
+// running.
+func (i *Instance) KeyEvent(key, mods Cell) {
+	if k := i.keyboard; k != nil {
+		k.mu.Lock()
+		k.q = append(k.q, key, mods)
+		k.cond.Broadcast()
+		k.mu.Unlock()
+	}
+}
+
+type keyboard struct {
+	mu   sync.Mutex
+	cond sync.Cond
+	q    []Cell
+}
+
+func (k *keyboard) wait(i *Instance, v, port Cell) error {
+	var r Cell
+	switch v {
+	case 1, 2, 3:
+		var b []Cell
+		r, b = i.devCall(func() (Cell, []Cell) {
+			k.mu.Lock()
+			defer k.mu.Unlock()
+			if v == 1 {
+				return Cell(len(k.q) / 2), nil
+			}
+			for v == 2 && len(k.q) == 0 {
+				k.cond.Wait()
+			}
+			if len(k.q) == 0 {
+				return 0, []Cell{0, 0}
+			}
+			b := append([]Cell(nil), k.q[:2]...)
+			k.q = k.q[2:]
+			return 0, b
+		})
+		if v != 1 && len(b) == 2 {
+			i.Push(b[0])
+			r = b[1]
+		}
+	}
+	i.WaitReply(r, port)
+	return nil
+}
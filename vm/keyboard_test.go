@@ -0,0 +1,72 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dobegor/ngaro/asm"
+	"github.com/dobegor/ngaro/vm"
+)
+
+func TestKeyboard(t *testing.T) {
+	img, err := asm.Assemble("Keyboard", strings.NewReader(`jump start
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:start
+		1 14 call io
+		2 14 call io
+		3 14 call io
+		3 14 call io
+		1 14 call io
+		`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := vm.New(img, "Keyboard", vm.Keyboard(14))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.KeyEvent(vm.KeyUp, vm.ModCtrl)
+	i.KeyEvent('q', 0)
+	if err = i.Run(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "Keyboard", "[2 -1 4 113 0 0 0 0]", fmt.Sprint(i.Data()))
+
+	// blocking read
+	img, err = asm.Assemble("Keyboard", strings.NewReader(`jump start
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:start
+		2 14 call io
+		`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err = vm.New(img, "Keyboard", vm.Keyboard(14))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go i.KeyEvent(vm.KeyF1, vm.ModShift)
+	if err = i.Run(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "Keyboard read", fmt.Sprintf("[%d 1]", vm.KeyF1), fmt.Sprint(i.Data()))
+}
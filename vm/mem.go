@@ -86,43 +86,26 @@ func load64(mem []Cell, r io.Reader, fileCells int) error {
 // Load loads a memory image from file fileName. Returns a VM Cell slice ready
 // to run from, the actual number of cells read from the file and any error. The
 // cellBits parameter specifies the number of bits per Cell in the file.
+//
+// Image files in the self-describing format written by SaveImage are detected
+// automatically, in which case cellBits is ignored and the returned memory
+// size is the one recorded in the file. Since Load only returns the memory,
+// such images are rejected if they have a non-zero entry point; they must be
+// loaded with LoadImage and run with the FromImage option. Images that require
+// instruction set extensions not supported by this VM are rejected as well.
+// The stack sizes requested by the image are ignored.
 func Load(fileName string, minSize, cellBits int) (mem []Cell, fileCells int, err error) {
-	switch cellBits {
-	case 0:
-		cellBits = CellBits
-	case 32, 64:
-	default:
-		return nil, 0, errors.Errorf("loading of %d bits images is not supported", cellBits)
-	}
-	f, err := os.Open(fileName)
-	if err != nil {
-		return nil, 0, errors.Wrap(err, "open failed")
-	}
-	defer f.Close()
-	st, err := f.Stat()
+	img, fileCells, err := loadImage(fileName, minSize, cellBits)
 	if err != nil {
-		return nil, 0, errors.Wrap(err, "fstat failed")
+		return nil, fileCells, err
 	}
-	sz := st.Size()
-	if sz > int64((^uint(0))>>1) { // MaxInt
-		return nil, 0, errors.Errorf("%v: file too large", fileName)
+	if img.Entry != 0 {
+		return nil, fileCells, errors.Errorf("%v: image has an entry point, use LoadImage and FromImage", fileName)
 	}
-	fileCells = int(sz / int64(cellBits/8))
-	imgCells := fileCells
-	if minSize > imgCells {
-		imgCells = minSize
-	}
-	mem = make([]Cell, imgCells)
-	switch cellBits {
-	case 32:
-		err = load32(mem, bufio.NewReader(f), fileCells)
-	case 64:
-		err = load64(mem, bufio.NewReader(f), fileCells)
-	}
-	if err != nil {
-		return nil, fileCells, errors.Wrap(err, "load failed")
+	if u := img.ISA &^ supportedISA(); u != 0 {
+		return nil, fileCells, errors.Errorf("%v: unsupported ISA extensions %#x", fileName, uint32(u))
 	}
-	return mem, fileCells, nil
+	return img.Mem, fileCells, nil
 }
 
 // Save saves a Cell slice to an memory image file. The cellBits parameter
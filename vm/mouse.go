@@ -0,0 +1,104 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import "sync"
+
+// Mouse button bits reported by the mouse device.
+const (
+	ButtonLeft Cell = 1 << iota
+	ButtonRight
+	ButtonMiddle
+)
+
+// Mouse binds the mouse device to port 7 and enables the mouse capability
+// query on port 5 (-7 returns -1). The pointer state is fed by the host with
+// PointerEvent.
+//
+// The following requests are supported on port 7 (stack effects in
+// parentheses):
+//
+//	1  position ( -- x y )
+//	2  buttons  ( -- b )
+//	3  changed  ( -- f )
+//
+// Requests 1 and 2 are defined by the Ngaro specification, 3 is an extension.
+// Buttons returns a bit mask of the pressed buttons (see ButtonLeft,
+// ButtonRight and ButtonMiddle). Changed returns -1 if a pointer event has been
+// received since the last position or buttons request, 0 otherwise.
+//
+// The pointer state belongs to the device. It is shared by clones of the
+// instance (see Clone).
+func Mouse() Option {
+	return func(i *Instance) error {
+		m := &mouse{}
+		i.mouse = m
+		i.bindWaitHandler(7, m.wait)
+		i.setDevCap(-7, -1)
+		return nil
+	}
+}
+
+// PointerEvent updates the state of the mouse device: x and y are the pointer
+// coordinates, relative to the top left corner of the canvas or terminal, and
+// buttons is a bit mask of the pressed buttons. It does nothing if the mouse
+// device is not enabled (see Mouse).
+//
+// PointerEvent is safe for concurrent use and can be called while the VM is
+// running.
+func (i *Instance) PointerEvent(x, y int, buttons Cell) {
+	if m := i.mouse; m != nil {
+		m.mu.Lock()
+		m.x, m.y, m.b, m.changed = Cell(x), Cell(y), buttons, true
+		m.mu.Unlock()
+	}
+}
+
+type mouse struct {
+	mu      sync.Mutex
+	x, y, b Cell
+	changed bool
+}
+
+func (m *mouse) wait(i *Instance, v, port Cell) error {
+	switch v {
+	case 1, 2, 3:
+		r, b := i.devCall(func() (Cell, []Cell) {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			if v == 3 {
+				if m.changed {
+					return -1, nil
+				}
+				return 0, nil
+			}
+			m.changed = false
+			if v == 1 {
+				return 0, []Cell{m.x, m.y}
+			}
+			return m.b, nil
+		})
+		if v == 1 && len(b) == 2 {
+			i.Push(b[0])
+			r = b[1]
+		}
+		i.WaitReply(r, port)
+	default:
+		i.WaitReply(0, port)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dobegor/ngaro/asm"
+	"github.com/dobegor/ngaro/vm"
+)
+
+func TestMouse(t *testing.T) {
+	img, err := asm.Assemble("Mouse", strings.NewReader(`jump start
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:start
+		-7 5 call io
+		3 7 call io
+		1 7 call io
+		2 7 call io
+		3 7 call io
+		`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := vm.New(img, "Mouse", vm.Mouse())
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.PointerEvent(12, 34, vm.ButtonLeft|vm.ButtonMiddle)
+	if err = i.Run(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "Mouse", "[-1 -1 12 34 5 0]", fmt.Sprint(i.Data()))
+
+	// no mouse
+	i, err = runAsmImage(`jump start
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:start
+		-7 5 call io
+		`, "Mouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.PointerEvent(1, 2, 0)
+	assertEqual(t, "No mouse", "[0]", fmt.Sprint(i.Data()))
+}
@@ -0,0 +1,383 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"net"
+	"sync"
+)
+
+// Size of the receive buffer of socket connections.
+const netBufSize = 64 << 10
+
+// Sockets binds a TCP socket device to the given WAIT port. The suggested port
+// is 10. The following requests are supported (stack effects in parentheses):
+//
+//	1  connect ( addr -- sd )
+//	2  listen  ( addr -- sd )
+//	3  accept  ( sd -- sd' )
+//	4  send    ( addr count sd -- n )
+//	5  recv    ( addr count sd -- n )
+//	6  close   ( sd -- f )
+//	7  poll    ( sd -- flags )
+//	8  address ( dst sd -- f )
+//
+// Connect and listen take a network address of the form "host:port", encoded
+// with the configured Codec, and return a socket descriptor, or 0 on failure.
+// Accept waits for an incoming connection on a listening socket and returns a
+// new socket descriptor for it, or 0 on failure.
+//
+// Send and recv transfer bytes between a connection and memory starting at
+// addr, one byte per cell. Send returns the number of bytes sent. Recv waits
+// until some data is available and returns the number of bytes received, at
+// most count. It returns 0 at end of stream or on error.
+//
+// Close returns 0 on success, 1 on failure. Address stores the local address
+// of the socket at dst and returns -1 on success, 0 on failure.
+//
+// Poll never blocks. It returns a bit mask where bit 0 is set if recv or accept
+// would not block, and bit 1 is set if the socket is a connection that can be
+// written to.
+//
+// Errors are reported through the error code returned by port 4 request -11
+// (see Errno). Connect and listen requests are subject to the CapConnect and
+// CapListen capabilities (see Policy).
+//
+// The socket table belongs to the device. It is shared by clones of the
+// instance (see Clone).
+func Sockets(port Cell) Option {
+	return func(i *Instance) error {
+		d := &netDevice{socks: make(map[Cell]netSocket), next: 1}
+		i.bindWaitHandler(port, d.wait)
+		return nil
+	}
+}
+
+type netSocket interface {
+	Close() error
+	readable() bool
+}
+
+type netDevice struct {
+	mu    sync.Mutex
+	socks map[Cell]netSocket
+	next  Cell
+}
+
+func (d *netDevice) add(s netSocket) Cell {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for ; d.socks[d.next] != nil; d.next++ {
+	}
+	d.socks[d.next] = s
+	return d.next
+}
+
+func (d *netDevice) get(i *Instance, sd Cell) netSocket {
+	d.mu.Lock()
+	s := d.socks[sd]
+	d.mu.Unlock()
+	if s == nil {
+		i.errno = ErrnoBadFD
+	}
+	return s
+}
+
+func (d *netDevice) conn(i *Instance, sd Cell) *netConn {
+	c, _ := d.get(i, sd).(*netConn)
+	if c == nil {
+		i.errno = ErrnoBadFD
+	}
+	return c
+}
+
+func (d *netDevice) wait(i *Instance, v, port Cell) error {
+	i.errno = ErrnoOK
+	var r Cell
+	switch v {
+	case 1, 2: // connect, listen
+		cp := CapConnect
+		if v == 2 {
+			cp = CapListen
+		}
+		name, ok := i.guestName(cp, port, i.Pop())
+		if !ok {
+			break
+		}
+		r, _ = i.devCall(func() (Cell, []Cell) {
+			if v == 1 {
+				c, err := net.Dial("tcp", name)
+				if err != nil {
+					i.setErrno(err)
+					return 0, nil
+				}
+				return d.add(newNetConn(c)), nil
+			}
+			l, err := net.Listen("tcp", name)
+			if err != nil {
+				i.setErrno(err)
+				return 0, nil
+			}
+			return d.add(newNetListener(l)), nil
+		})
+	case 3: // accept
+		sd := i.Pop()
+		r, _ = i.devCall(func() (Cell, []Cell) {
+			l, _ := d.get(i, sd).(*netListener)
+			if l == nil {
+				i.errno = ErrnoBadFD
+				return 0, nil
+			}
+			c, err := l.accept()
+			if err != nil {
+				i.setErrno(err)
+				return 0, nil
+			}
+			return d.add(newNetConn(c)), nil
+		})
+	case 4: // send
+		sd, count, addr := i.Pop(), i.Pop(), i.Pop()
+		if !i.inMem(addr, count) {
+			i.errno = ErrnoInvalid
+			break
+		}
+		b := cellsToBytes(i.Mem[addr : addr+count])
+		r, _ = i.devCall(func() (Cell, []Cell) {
+			c := d.conn(i, sd)
+			if c == nil {
+				return 0, nil
+			}
+			n, err := c.c.Write(b)
+			i.setErrno(err)
+			return Cell(n), nil
+		})
+	case 5: // recv
+		sd, count, addr := i.Pop(), i.Pop(), i.Pop()
+		if !i.inMem(addr, count) {
+			i.errno = ErrnoInvalid
+			break
+		}
+		var b []Cell
+		r, b = i.devCall(func() (Cell, []Cell) {
+			c := d.conn(i, sd)
+			if c == nil {
+				return 0, nil
+			}
+			b, err := c.recv(int(count))
+			i.setErrno(err)
+			return Cell(len(b)), bytesToCells(b)
+		})
+		i.UnshareMem()
+		copy(i.Mem[addr:], b)
+	case 6: // close
+		sd := i.Pop()
+		r, _ = i.devCall(func() (Cell, []Cell) {
+			s := d.get(i, sd)
+			if s == nil {
+				return 1, nil
+			}
+			d.mu.Lock()
+			delete(d.socks, sd)
+			if sd < d.next {
+				d.next = sd
+			}
+			d.mu.Unlock()
+			if err := s.Close(); err != nil {
+				i.setErrno(err)
+				return 1, nil
+			}
+			return 0, nil
+		})
+	case 7: // poll
+		sd := i.Pop()
+		r, _ = i.devCall(func() (Cell, []Cell) {
+			var f Cell
+			s := d.get(i, sd)
+			if s != nil && s.readable() {
+				f |= 1
+			}
+			if _, ok := s.(*netConn); ok {
+				f |= 2
+			}
+			return f, nil
+		})
+	case 8: // address
+		sd, dst := i.Pop(), i.Pop()
+		if i.sEnc == nil {
+			i.errno = ErrnoInvalid
+			break
+		}
+		var b []Cell
+		r, b = i.devCall(func() (Cell, []Cell) {
+			var a net.Addr
+			switch s := d.get(i, sd).(type) {
+			case *netConn:
+				a = s.c.LocalAddr()
+			case *netListener:
+				a = s.l.Addr()
+			default:
+				return 0, nil
+			}
+			return -1, bytesToCells([]byte(a.String()))
+		})
+		if r != 0 {
+			i.UnshareMem()
+			i.sEnc.Encode(i.Mem, dst, cellsToBytes(b))
+		}
+	default:
+		i.errno = ErrnoInvalid
+	}
+	i.WaitReply(r, port)
+	return nil
+}
+
+// netConn is a TCP connection. Incoming data is read in the background so that
+// the connection can be polled for readability.
+type netConn struct {
+	c      net.Conn
+	mu     sync.Mutex
+	cond   sync.Cond
+	buf    []byte
+	err    error
+	closed bool
+}
+
+func newNetConn(c net.Conn) *netConn {
+	s := &netConn{c: c}
+	s.cond.L = &s.mu
+	go s.read()
+	return s
+}
+
+func (s *netConn) read() {
+	var b [4096]byte
+	for {
+		n, err := s.c.Read(b[:])
+		s.mu.Lock()
+		s.buf = append(s.buf, b[:n]...)
+		s.err = err
+		s.cond.Broadcast()
+		for len(s.buf) >= netBufSize && !s.closed {
+			s.cond.Wait()
+		}
+		closed := s.closed
+		s.mu.Unlock()
+		if err != nil || closed {
+			return
+		}
+	}
+}
+
+// recv waits until data is available and returns at most n bytes.
+func (s *netConn) recv(n int) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.buf) == 0 && s.err == nil {
+		s.cond.Wait()
+	}
+	if len(s.buf) == 0 {
+		return nil, s.err
+	}
+	if n > len(s.buf) {
+		n = len(s.buf)
+	}
+	b := append([]byte(nil), s.buf[:n]...)
+	s.buf = s.buf[n:]
+	s.cond.Broadcast()
+	return b, nil
+}
+
+func (s *netConn) readable() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.buf) > 0 || s.err != nil
+}
+
+func (s *netConn) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	return s.c.Close()
+}
+
+// netListener is a listening TCP socket. Incoming connections are accepted in
+// the background so that the socket can be polled.
+type netListener struct {
+	l       net.Listener
+	ch      chan net.Conn
+	done    chan struct{}
+	err     error
+	pending net.Conn
+	eof     bool
+}
+
+func newNetListener(l net.Listener) *netListener {
+	s := &netListener{l: l, ch: make(chan net.Conn), done: make(chan struct{})}
+	go s.listen()
+	return s
+}
+
+func (s *netListener) listen() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			s.err = err
+			close(s.ch)
+			return
+		}
+		select {
+		case s.ch <- c:
+		case <-s.done:
+			c.Close()
+			return
+		}
+	}
+}
+
+func (s *netListener) accept() (net.Conn, error) {
+	if c := s.pending; c != nil {
+		s.pending = nil
+		return c, nil
+	}
+	if !s.eof {
+		if c, ok := <-s.ch; ok {
+			return c, nil
+		}
+		s.eof = true
+	}
+	return nil, s.err
+}
+
+func (s *netListener) readable() bool {
+	if s.pending == nil && !s.eof {
+		select {
+		case c, ok := <-s.ch:
+			s.pending, s.eof = c, !ok
+		default:
+		}
+	}
+	return s.pending != nil || s.eof
+}
+
+func (s *netListener) Close() error {
+	close(s.done)
+	if s.pending != nil {
+		s.pending.Close()
+	}
+	return s.l.Close()
+}
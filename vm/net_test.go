@@ -0,0 +1,95 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/dobegor/ngaro/vm"
+)
+
+var netTest = `
+	jump start
+	.org 32
+	:io dup push out 0 0 out wait pop in ;
+	:net 10 call io ;
+	:any .dat "127.0.0.1:0"
+	:msg .dat "hi"
+	.org 64
+	:addr
+	.org 96
+	:buf .dat 0 0 0 0
+	:l .dat 0
+	:c .dat 0
+	:s .dat 0
+	.org 112
+	:start
+		lit any 2 call net lit l !
+		lit addr lit l @ 8 call net drop
+		lit addr 1 call net lit c !
+		lit l @ 3 call net lit s !
+		lit msg 2 lit c @ 4 call net
+	:1	lit s @ 7 call net 1 and 0 =jump 1-
+		lit buf 4 lit s @ 5 call net
+		lit c @ 6 call net
+		lit buf 4 lit s @ 5 call net
+		-11 4 call io
+		lit s @ 6 call net
+		lit l @ 6 call net
+`
+
+func TestSockets(t *testing.T) {
+	var log bytes.Buffer
+	i, err := runAsmImage(netTest, "Sockets", vm.Sockets(10), vm.StringCodec(testCodec{}), vm.Record(&log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "Sockets", "[2 2 0 0 1 0 0]", fmt.Sprint(i.Data()))
+	assertEqual(t, "Sockets recv", "hi", string(testCodec{}.Decode(i.Mem, 96)))
+
+	// replay without touching the network
+	j, err := runAsmImage(netTest, "Sockets", vm.Sockets(10), vm.StringCodec(testCodec{}), vm.Replay(&log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "Sockets replay", fmt.Sprint(i.Data()), fmt.Sprint(j.Data()))
+	assertEqual(t, "Sockets replay address", string(testCodec{}.Decode(i.Mem, 64)), string(testCodec{}.Decode(j.Mem, 64)))
+}
+
+func TestSockets_policy(t *testing.T) {
+	var req []string
+	i, err := runAsmImage(`jump start
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:host .dat "example.com:80"
+		.org 64
+		:start
+			lit host 1 10 call io
+			-11 4 call io
+		`, "Sockets_policy", vm.Sockets(10), vm.StringCodec(testCodec{}),
+		vm.Policy(func(i *vm.Instance, r vm.Request) bool {
+			req = append(req, fmt.Sprintf("%v %s", r.Cap, r.Name))
+			return r.Cap != vm.CapConnect
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "Sockets_policy", "[0 4]", fmt.Sprint(i.Data()))
+	assertEqual(t, "Sockets_policy requests", "[device  connect example.com:80]", fmt.Sprint(req))
+}
@@ -0,0 +1,126 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import "strconv"
+
+// Capability identifies a sensitive operation that can be requested by guest
+// programs.
+type Capability int
+
+// Capabilities checked by the Policy option.
+const (
+	CapEnv       Capability = iota + 1 // environment query (port 5, -10)
+	CapExit                            // VM exit (port 5, -9)
+	CapSaveImage                       // image save (port 4, 1)
+	CapInclude                         // file include (port 4, 2)
+	CapOpen                            // file open (port 4, -1)
+	CapDelete                          // file or directory delete (port 4, -8 and -15)
+	CapDevice                          // WAIT on any port other than 1, 2, 4, 5 and 8
+	CapStat                            // directory listing and file metadata (port 4, -12, -17 and -18)
+	CapMkdir                           // directory creation (port 4, -14)
+	CapRename                          // file rename (port 4, -16)
+	CapConnect                         // outgoing network connection (Sockets)
+	CapListen                          // incoming network connections (Sockets)
+	CapHTTP                            // HTTP request (HTTPClient)
+)
+
+var capNames = [...]string{
+	CapEnv:       "env",
+	CapExit:      "exit",
+	CapSaveImage: "save image",
+	CapInclude:   "include",
+	CapOpen:      "open",
+	CapDelete:    "delete",
+	CapDevice:    "device",
+	CapStat:      "stat",
+	CapMkdir:     "mkdir",
+	CapRename:    "rename",
+	CapConnect:   "connect",
+	CapListen:    "listen",
+	CapHTTP:      "http",
+}
+
+func (c Capability) String() string {
+	if c > 0 && int(c) < len(capNames) {
+		return capNames[c]
+	}
+	return "Capability(" + strconv.Itoa(int(c)) + ")"
+}
+
+// Request describes a capability request from a guest program.
+//
+// Name is the file name for file operations, the variable name for CapEnv, the
+// network address for CapConnect and CapListen, the URL for CapHTTP and the
+// image file name for CapSaveImage. NewName is the new file name for
+// CapRename. Mode is the open mode for CapOpen and the value written to the port
+// for CapDevice.
+type Request struct {
+	Cap     Capability
+	Port    Cell
+	Name    string
+	Mode    Cell
+	NewName string
+}
+
+// PolicyFunc is the prototype for policy functions. It returns true if the
+// request is granted.
+type PolicyFunc func(i *Instance, r Request) bool
+
+// Policy sets a policy function that is called every time a guest program
+// requests one of the capabilities listed above. It can be used to audit and
+// to deny individual requests.
+//
+// When a request is denied, the operation is not performed and the guest gets
+// the following results:
+//
+//	CapEnv        the destination buffer is set to an empty string
+//	CapExit       port 5 is set to -1 and execution continues
+//	CapSaveImage  port 4 is set to -1
+//	CapInclude    port 4 is set to -1, the address of the file name is dropped
+//	CapOpen       port 4 is set to 0, like when the file cannot be opened
+//	CapDelete     port 4 is set to 0, like when the file cannot be deleted
+//	CapDevice     the WAIT handler is not called; the port is set to 0
+//
+// Other denied operations fail like when the file does not exist or the
+// connection cannot be established. In all cases, port 0 is set to 1, and
+// except for CapDevice, the stack arguments of the request are consumed.
+// Since the VM does not know the stack effect of device requests, the
+// arguments of a denied CapDevice request are left on the stack: guests
+// should check the port value before using the stack. Denied file and network
+// operations set the error code to ErrnoPermission.
+func Policy(fn PolicyFunc) Option {
+	return func(i *Instance) error {
+		i.policy = fn
+		return nil
+	}
+}
+
+// allow checks a capability request against the instance's policy.
+func (i *Instance) allow(c Capability, port Cell, name string, mode Cell) bool {
+	return i.policy == nil || i.policy(i, Request{Cap: c, Port: port, Name: name, Mode: mode})
+}
+
+// isDevicePort returns true if WAIT requests on the given port are subject to
+// the CapDevice capability.
+func isDevicePort(port Cell) bool {
+	switch port {
+	case 1, 2, 4, 5, 8:
+		return false
+	}
+	return true
+}
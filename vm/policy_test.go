@@ -0,0 +1,101 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm_test
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dobegor/ngaro/vm"
+)
+
+func TestPolicy(t *testing.T) {
+	fsys := vm.NewMemFS(nil)
+	f, err := fsys.OpenFile("f", os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	h := vm.NewDeterministicHost(time.Time{}, map[string]string{"f": "value"}, nil, fsys)
+
+	var log []string
+	i, err := runAsmImage(`jump start
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		.org 64
+		:name .dat "f"
+		.org 80
+		:buf .dat 1 1 1 1
+		:start
+			lit buf lit name -10 5 call io
+			lit name 0 -1 4 call io
+			lit name -8 4 call io
+			1 4 call io
+			lit name 2 4 call io
+			7 20 call io
+			-9 5 call io
+			42
+		`, "Policy",
+		vm.Delegate(h),
+		vm.StringCodec(testCodec{}),
+		vm.BindWaitHandler(20, func(i *vm.Instance, v, port vm.Cell) error {
+			i.WaitReply(99, port)
+			return nil
+		}),
+		vm.Policy(func(i *vm.Instance, r vm.Request) bool {
+			log = append(log, fmt.Sprintf("%v:%d:%s:%d", r.Cap, r.Port, r.Name, r.Mode))
+			return false
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "Policy results", "[0 0 0 -1 -1 0 -1 42]", fmt.Sprint(i.Data()))
+	assertEqualI(t, "Policy env", 0, int(i.Mem[80]))
+	assertEqual(t, "Policy log",
+		"env:5:f:0 open:4:f:0 delete:4:f:0 save image:4:Policy:0 include:4:f:0 device:20::7 exit:5::0",
+		strings.Join(log, " "))
+	if _, err = fsys.Open("f"); err != nil {
+		t.Errorf("Policy: %v", err)
+	}
+
+	// allow everything
+	i, err = runAsmImage(`jump start
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		.org 64
+		:name .dat "f"
+		:start
+			7 20 call io
+			lit name -8 4 call io
+			-9 5 call io
+			42
+		`, "Policy",
+		vm.Delegate(h),
+		vm.StringCodec(testCodec{}),
+		vm.BindWaitHandler(20, func(i *vm.Instance, v, port vm.Cell) error {
+			i.WaitReply(99, port)
+			return nil
+		}),
+		vm.Policy(func(*vm.Instance, vm.Request) bool { return true }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "Policy allowed", "[99 -1]", fmt.Sprint(i.Data()))
+}
@@ -0,0 +1,137 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/rand/v2"
+	"sync"
+)
+
+// Random binds a random number device to the given WAIT port. The suggested
+// port is 13. The pseudo-random number generator is initialized with the given
+// seed so that the sequence of numbers returned to the guest can be reproduced.
+// The following requests are supported (stack effects in parentheses):
+//
+//	1  seed    ( s -- 0 )
+//	2  next    ( -- n )
+//	3  bounded ( n -- r )
+//	4  float   ( -- f )
+//	5  mode    ( m -- 0 )
+//
+// Seed re-initializes the generator. Next returns a non-negative random
+// number. Bounded returns a random number r with 0 <= r < n, or 0 if n is not
+// positive. Float returns a random FCell in [0, 1).
+//
+// Mode selects the source of random numbers for next, bounded and float: the
+// seeded generator if m is 0, or a cryptographically secure generator from the
+// host if m is 1.
+//
+// Unknown requests, and bounded requests with a non-positive n, set the error
+// code returned by port 4 request -11 to ErrnoInvalid (see Errno).
+//
+// The generator and the mode belong to the device. They are shared by clones of
+// the instance (see Clone).
+func Random(port Cell, seed int64) Option {
+	return func(i *Instance) error {
+		d := &randomDevice{}
+		d.seed(Cell(seed))
+		i.bindWaitHandler(port, d.wait)
+		return nil
+	}
+}
+
+// randomDevice holds the state of a random number device. Since clones share
+// their devices, mu guards the generator and the mode.
+type randomDevice struct {
+	mu     sync.Mutex
+	prng   *rand.Rand
+	crypto bool
+}
+
+func (d *randomDevice) seed(s Cell) {
+	d.prng = rand.New(rand.NewPCG(uint64(s), 0))
+}
+
+func (d *randomDevice) src() *rand.Rand {
+	if d.crypto {
+		return cryptoRand
+	}
+	return d.prng
+}
+
+// cryptoSource is a rand.Source that reads from crypto/rand.
+type cryptoSource struct{}
+
+func (cryptoSource) Uint64() uint64 {
+	var b [8]byte
+	crand.Read(b[:])
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+var cryptoRand = rand.New(cryptoSource{})
+
+// call returns a device call function that runs fn with d locked.
+func (d *randomDevice) call(fn func() Cell) func() (Cell, []Cell) {
+	return func() (Cell, []Cell) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return fn(), nil
+	}
+}
+
+func (d *randomDevice) wait(i *Instance, v, port Cell) error {
+	i.errno = ErrnoOK
+	var r Cell
+	switch v {
+	case 1: // seed
+		s := i.Pop()
+		i.devCall(d.call(func() Cell {
+			d.seed(s)
+			return 0
+		}))
+	case 2: // next
+		r, _ = i.devCall(d.call(func() Cell {
+			return Cell(d.src().Int64())
+		}))
+	case 3: // bounded
+		n := i.Pop()
+		if n <= 0 {
+			i.errno = ErrnoInvalid
+			break
+		}
+		r, _ = i.devCall(d.call(func() Cell {
+			return Cell(d.src().Int64N(int64(n)))
+		}))
+	case 4: // float
+		r, _ = i.devCall(d.call(func() Cell {
+			f := FCell(d.src().Float64())
+			return *f.AsCell()
+		}))
+	case 5: // mode
+		m := i.Pop()
+		i.devCall(d.call(func() Cell {
+			d.crypto = m == 1
+			return 0
+		}))
+	default:
+		i.errno = ErrnoInvalid
+	}
+	i.WaitReply(r, port)
+	return nil
+}
@@ -0,0 +1,105 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm_test
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dobegor/ngaro/asm"
+	"github.com/dobegor/ngaro/vm"
+)
+
+var randomTest = `jump start
+	.org 32
+	:io dup push out 0 0 out wait pop in ;
+	:rnd 13 call io ;
+	:start
+		2 call rnd
+		10 3 call rnd
+		4 call rnd
+		0 3 call rnd
+		42 1 call rnd drop
+		2 call rnd
+		1 5 call rnd drop
+		1000000 3 call rnd
+		0 3 call rnd drop -11 4 call io
+		99 call rnd drop -11 4 call io
+	`
+
+func TestRandom(t *testing.T) {
+	run := func(seed int64) []vm.Cell {
+		i, err := runAsmImage(randomTest, "Random", vm.Random(13, seed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return i.Data()
+	}
+	a, b := run(1), run(1)
+	assertEqual(t, "Random seed", fmt.Sprint(a[:5]), fmt.Sprint(b[:5]))
+	if a[0] < 0 {
+		t.Errorf("Random next: got negative value %d", a[0])
+	}
+	if a[1] < 0 || a[1] >= 10 {
+		t.Errorf("Random bounded: %d out of range", a[1])
+	}
+	if f := *a[2].AsFCell(); f < 0 || f >= 1 {
+		t.Errorf("Random float: %g out of range", f)
+	}
+	assertEqualI(t, "Random bounded 0", 0, int(a[3]))
+	c := run(42)
+	assertEqualI(t, "Random reseed", int(c[4]), int(a[4]))
+	if a[5] < 0 || a[5] >= 1000000 {
+		t.Errorf("Random crypto: %d out of range", a[5])
+	}
+	if a[0] == c[0] {
+		t.Error("Random: same value for different seeds")
+	}
+	assertEqualI(t, "Random bounded 0 errno", int(vm.ErrnoInvalid), int(a[6]))
+	assertEqualI(t, "Random unknown errno", int(vm.ErrnoInvalid), int(a[7]))
+}
+
+func TestRandom_clone(t *testing.T) {
+	img, err := asm.Assemble("Random_clone", strings.NewReader(`jump start
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:rnd 13 call io ;
+		:start
+			`+strings.Repeat("2 call rnd drop 10 3 call rnd drop 4 call rnd drop\n", 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := vm.New(img, "", vm.Random(13, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// clones share the device and run concurrently
+	var wg sync.WaitGroup
+	for k := 0; k < 4; k++ {
+		c := i.Clone()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Run(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,621 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Record configures the VM to log every value entering it from the outside
+// world to w: input bytes read on port 1, the time, environment variables and
+// console size queried on port 5, the results of all file operations on port
+// 4, the results of requests to the devices provided by this package (like
+// Sockets) and the values pushed by custom IN handlers. Each entry is tagged
+// with the instruction count at which it occurred.
+//
+// Custom IN handlers are expected to push exactly one value onto the data
+// stack. Values produced by custom WAIT and OUT handlers or by custom opcodes
+// are not recorded.
+//
+// Writes to w are buffered and flushed when Run returns.
+func Record(w io.Writer) Option {
+	return func(i *Instance) error {
+		if _, err := io.WriteString(w, tapeMagic); err != nil {
+			return errors.Wrap(err, "record failed")
+		}
+		i.tape = &tape{w: bufio.NewWriter(w)}
+		return nil
+	}
+}
+
+// Replay configures the VM to replay a log created with Record. All values that
+// would normally come from the Host, the input stack or custom IN handlers are
+// read from the log instead, so that a recorded session can be reproduced
+// exactly, provided that the VM runs the same image with the same options.
+//
+// Output to the Terminal and image saves are performed as usual, but writes to
+// files opened by the guest program are not.
+//
+// If the VM diverges from the recorded session, Run fails with an error.
+func Replay(r io.Reader) Option {
+	return func(i *Instance) error {
+		br, ok := r.(tapeReader)
+		if !ok {
+			br = bufio.NewReader(r)
+		}
+		var m [len(tapeMagic)]byte
+		if _, err := io.ReadFull(br, m[:]); err != nil || string(m[:]) != tapeMagic {
+			return errors.New("replay failed: not a VM record")
+		}
+		i.tape = &tape{r: br}
+		return nil
+	}
+}
+
+const tapeMagic = "NGRL\x01"
+
+// tape event kinds.
+const (
+	evInput byte = iota + 1
+	evTime
+	evEnv
+	evSize
+	evIn
+	evOpen
+	evRead
+	evWrite
+	evSeek
+	evStat
+	evClose
+	evRemove
+	evMkdir
+	evRename
+	evStatName
+	evReadDir
+	evDevice
+)
+
+// error kinds.
+const (
+	errNil = iota
+	errEOF
+	errNotExist
+	errPermission
+	errExist
+	errOther
+	errInvalid
+	errClosed
+)
+
+type tapeReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// tape records or replays the nondeterministic inputs of a VM.
+//
+// Events are encoded as a kind byte followed by the instruction count and
+// the event payload. Errors during recording or replay cause a panic that will
+// be recovered by Run.
+type tape struct {
+	w   io.Writer
+	r   tapeReader
+	buf []byte
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (t *tape) replaying() bool { return t.r != nil }
+
+func (t *tape) begin(i *Instance, kind byte) {
+	t.buf = append(t.buf[:0], kind)
+	t.putUint(uint64(i.position()))
+}
+
+func (t *tape) putUint(v uint64) {
+	n := binary.PutUvarint(t.tmp[:], v)
+	t.buf = append(t.buf, t.tmp[:n]...)
+}
+
+func (t *tape) putInt(v int64) {
+	n := binary.PutVarint(t.tmp[:], v)
+	t.buf = append(t.buf, t.tmp[:n]...)
+}
+
+func (t *tape) putBytes(b []byte) {
+	t.putUint(uint64(len(b)))
+	t.buf = append(t.buf, b...)
+}
+
+func (t *tape) putError(err error) {
+	switch {
+	case err == nil:
+		t.putUint(errNil)
+	case err == io.EOF:
+		t.putUint(errEOF)
+	case os.IsNotExist(err):
+		t.putUint(errNotExist)
+	case os.IsPermission(err):
+		t.putUint(errPermission)
+	case os.IsExist(err):
+		t.putUint(errExist)
+	case errors.Is(err, os.ErrInvalid):
+		t.putUint(errInvalid)
+	case errors.Is(err, os.ErrClosed):
+		t.putUint(errClosed)
+	default:
+		t.putUint(errOther)
+		t.putBytes([]byte(err.Error()))
+	}
+}
+
+// putFileInfo records the result of a stat operation.
+func (t *tape) putFileInfo(fi os.FileInfo, err error) {
+	if err == nil {
+		t.putInt(fi.Size())
+		t.putUint(uint64(fi.Mode()))
+		t.putInt(fi.ModTime().UnixNano())
+	} else {
+		t.putInt(0)
+		t.putUint(0)
+		t.putInt(0)
+	}
+	t.putError(err)
+}
+
+func (t *tape) end() {
+	if _, err := t.w.Write(t.buf); err != nil {
+		panic(errors.Wrap(err, "record failed"))
+	}
+}
+
+// flush flushes buffered records.
+func (t *tape) flush() error {
+	if bw, ok := t.w.(*bufio.Writer); ok {
+		return errors.Wrap(bw.Flush(), "record failed")
+	}
+	return nil
+}
+
+func (t *tape) fail(err error) {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	panic(errors.Wrap(err, "replay failed"))
+}
+
+// next reads the header of the next event and checks that it matches the
+// current VM state.
+func (t *tape) next(i *Instance, kind byte) {
+	k, err := t.r.ReadByte()
+	if err != nil {
+		t.fail(err)
+	}
+	cnt := t.uint()
+	if k != kind || cnt != uint64(i.position()) {
+		panic(errors.Errorf("replay failed: diverged from record at instruction %d: expected event %d, got %d @%d",
+			i.position(), kind, k, cnt))
+	}
+}
+
+func (t *tape) uint() uint64 {
+	v, err := binary.ReadUvarint(t.r)
+	if err != nil {
+		t.fail(err)
+	}
+	return v
+}
+
+func (t *tape) int() int64 {
+	v, err := binary.ReadVarint(t.r)
+	if err != nil {
+		t.fail(err)
+	}
+	return v
+}
+
+// bytes reads a byte string. The buffer grows as data is read, so that a
+// corrupt length cannot trigger a huge allocation.
+func (t *tape) bytes() []byte {
+	n := t.uint()
+	if n > uint64(maxInt) {
+		t.fail(errors.Errorf("invalid length %d", n))
+	}
+	var b bytes.Buffer
+	if _, err := io.CopyN(&b, t.r, int64(n)); err != nil {
+		t.fail(err)
+	}
+	return b.Bytes()
+}
+
+func (t *tape) fileInfo() *tapeFileInfo {
+	return &tapeFileInfo{size: t.int(), mode: os.FileMode(t.uint()), modTime: time.Unix(0, t.int())}
+}
+
+func (t *tape) error(op, name string) error {
+	switch t.uint() {
+	case errNil:
+		return nil
+	case errEOF:
+		return io.EOF
+	case errNotExist:
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	case errPermission:
+		return &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+	case errExist:
+		return &os.PathError{Op: op, Path: name, Err: os.ErrExist}
+	case errInvalid:
+		return &os.PathError{Op: op, Path: name, Err: os.ErrInvalid}
+	case errClosed:
+		return &os.PathError{Op: op, Path: name, Err: os.ErrClosed}
+	default:
+		return errors.New(string(t.bytes()))
+	}
+}
+
+// Access to the outside world. All nondeterministic inputs go through these
+// functions so that they can be recorded or replayed.
+
+func (i *Instance) now() time.Time {
+	t := i.tape
+	if t == nil {
+		return i.clock.Now()
+	}
+	if t.replaying() {
+		t.next(i, evTime)
+		return time.Unix(0, t.int())
+	}
+	now := i.clock.Now()
+	t.begin(i, evTime)
+	t.putInt(now.UnixNano())
+	t.end()
+	return now
+}
+
+func (i *Instance) getenv(key string) string {
+	t := i.tape
+	if t == nil {
+		return i.env.Getenv(key)
+	}
+	if t.replaying() {
+		t.next(i, evEnv)
+		return string(t.bytes())
+	}
+	v := i.env.Getenv(key)
+	t.begin(i, evEnv)
+	t.putBytes([]byte(v))
+	t.end()
+	return v
+}
+
+func (i *Instance) consoleSize() (w, h int) {
+	t := i.tape
+	if t != nil && t.replaying() {
+		t.next(i, evSize)
+		return int(t.int()), int(t.int())
+	}
+	if i.output != nil {
+		w, h = i.output.Size()
+	}
+	if t != nil {
+		t.begin(i, evSize)
+		t.putInt(int64(w))
+		t.putInt(int64(h))
+		t.end()
+	}
+	return w, h
+}
+
+func (i *Instance) readInput(b []byte) (n int, err error) {
+	t := i.tape
+	if t != nil && t.replaying() {
+		t.next(i, evInput)
+		n = copy(b, t.bytes())
+		return n, t.error("read", "")
+	}
+	if i.input != nil {
+		n, err = i.input.Read(b)
+	} else {
+		err = io.EOF
+	}
+	if t != nil {
+		t.begin(i, evInput)
+		t.putBytes(b[:n])
+		t.putError(err)
+		t.end()
+	}
+	return n, err
+}
+
+// callIn calls a custom IN handler.
+func (i *Instance) callIn(h InHandler, port Cell) error {
+	t := i.tape
+	if t == nil {
+		return h(i, port)
+	}
+	if t.replaying() {
+		t.next(i, evIn)
+		i.Push(Cell(t.int()))
+		return nil
+	}
+	if err := h(i, port); err != nil {
+		return err
+	}
+	t.begin(i, evIn)
+	t.putInt(int64(i.tos))
+	t.end()
+	return nil
+}
+
+// openFile opens a file for use by the guest program.
+func (i *Instance) openFile(name string, flag int, perm os.FileMode) (File, error) {
+	t := i.tape
+	f, err := i.fsOpen(name, flag, perm)
+	if err != nil || t == nil || t.replaying() {
+		return f, err
+	}
+	return &tapeFile{i, f}, nil
+}
+
+// fsOpen opens a file through the Host FS. Only the result of the open
+// operation is recorded, not subsequent operations on the returned File. This
+// is used by include where data read from the file is recorded as regular
+// input.
+func (i *Instance) fsOpen(name string, flag int, perm os.FileMode) (File, error) {
+	t := i.tape
+	if t == nil {
+		return i.fs.OpenFile(name, flag, perm)
+	}
+	if t.replaying() {
+		t.next(i, evOpen)
+		if err := t.error("open", name); err != nil {
+			return nil, err
+		}
+		return &tapeFile{i, nil}, nil
+	}
+	f, err := i.fs.OpenFile(name, flag, perm)
+	t.begin(i, evOpen)
+	t.putError(err)
+	t.end()
+	return f, err
+}
+
+func (i *Instance) removeFile(name string) error {
+	t := i.tape
+	if t == nil {
+		return i.fs.Remove(name)
+	}
+	if t.replaying() {
+		t.next(i, evRemove)
+		return t.error("remove", name)
+	}
+	err := i.fs.Remove(name)
+	t.begin(i, evRemove)
+	t.putError(err)
+	t.end()
+	return err
+}
+
+func (i *Instance) mkdir(name string, perm os.FileMode) error {
+	t := i.tape
+	if t == nil {
+		return i.fs.Mkdir(name, perm)
+	}
+	if t.replaying() {
+		t.next(i, evMkdir)
+		return t.error("mkdir", name)
+	}
+	err := i.fs.Mkdir(name, perm)
+	t.begin(i, evMkdir)
+	t.putError(err)
+	t.end()
+	return err
+}
+
+func (i *Instance) rename(oldname, newname string) error {
+	t := i.tape
+	if t == nil {
+		return i.fs.Rename(oldname, newname)
+	}
+	if t.replaying() {
+		t.next(i, evRename)
+		return t.error("rename", oldname)
+	}
+	err := i.fs.Rename(oldname, newname)
+	t.begin(i, evRename)
+	t.putError(err)
+	t.end()
+	return err
+}
+
+func (i *Instance) stat(name string) (os.FileInfo, error) {
+	t := i.tape
+	if t == nil {
+		return i.fs.Stat(name)
+	}
+	if t.replaying() {
+		t.next(i, evStatName)
+		fi := t.fileInfo()
+		if err := t.error("stat", name); err != nil {
+			return nil, err
+		}
+		return fi, nil
+	}
+	fi, err := i.fs.Stat(name)
+	t.begin(i, evStatName)
+	t.putFileInfo(fi, err)
+	t.end()
+	return fi, err
+}
+
+// readDir returns the names of the entries in the given directory.
+func (i *Instance) readDir(name string) ([]string, error) {
+	t := i.tape
+	if t != nil && t.replaying() {
+		t.next(i, evReadDir)
+		names := make([]string, t.uint())
+		for k := range names {
+			names[k] = string(t.bytes())
+		}
+		return names, t.error("readdir", name)
+	}
+	l, err := i.fs.ReadDir(name)
+	names := make([]string, len(l))
+	for k, e := range l {
+		names[k] = e.Name()
+	}
+	if t != nil {
+		t.begin(i, evReadDir)
+		t.putUint(uint64(len(names)))
+		for _, n := range names {
+			t.putBytes([]byte(n))
+		}
+		t.putError(err)
+		t.end()
+	}
+	return names, err
+}
+
+// devCall performs a device request with nondeterministic results. fn does the
+// actual work and returns the reply value and any data to be written to memory
+// by the caller. The reply, the data and errno are recorded. When replaying, fn
+// is not called and the results are read from the tape instead.
+func (i *Instance) devCall(fn func() (Cell, []Cell)) (Cell, []Cell) {
+	t := i.tape
+	if t == nil {
+		return fn()
+	}
+	if t.replaying() {
+		t.next(i, evDevice)
+		r := Cell(t.int())
+		i.errno = Errno(t.int())
+		data := make([]Cell, t.uint())
+		for k := range data {
+			data[k] = Cell(t.int())
+		}
+		return r, data
+	}
+	r, data := fn()
+	t.begin(i, evDevice)
+	t.putInt(int64(r))
+	t.putInt(int64(i.errno))
+	t.putUint(uint64(len(data)))
+	for _, v := range data {
+		t.putInt(int64(v))
+	}
+	t.end()
+	return r, data
+}
+
+// tapeFile records or replays operations on a File.
+type tapeFile struct {
+	i *Instance
+	f File // nil when replaying
+}
+
+func (f *tapeFile) Read(p []byte) (n int, err error) {
+	i, t := f.i, f.i.tape
+	if t.replaying() {
+		t.next(i, evRead)
+		n = copy(p, t.bytes())
+		return n, t.error("read", "")
+	}
+	n, err = f.f.Read(p)
+	t.begin(i, evRead)
+	t.putBytes(p[:n])
+	t.putError(err)
+	t.end()
+	return n, err
+}
+
+func (f *tapeFile) Write(p []byte) (n int, err error) {
+	i, t := f.i, f.i.tape
+	if t.replaying() {
+		t.next(i, evWrite)
+		return int(t.int()), t.error("write", "")
+	}
+	n, err = f.f.Write(p)
+	t.begin(i, evWrite)
+	t.putInt(int64(n))
+	t.putError(err)
+	t.end()
+	return n, err
+}
+
+func (f *tapeFile) Seek(offset int64, whence int) (pos int64, err error) {
+	i, t := f.i, f.i.tape
+	if t.replaying() {
+		t.next(i, evSeek)
+		return t.int(), t.error("seek", "")
+	}
+	pos, err = f.f.Seek(offset, whence)
+	t.begin(i, evSeek)
+	t.putInt(pos)
+	t.putError(err)
+	t.end()
+	return pos, err
+}
+
+func (f *tapeFile) Stat() (os.FileInfo, error) {
+	i, t := f.i, f.i.tape
+	if t.replaying() {
+		t.next(i, evStat)
+		fi := t.fileInfo()
+		if err := t.error("stat", ""); err != nil {
+			return nil, err
+		}
+		return fi, nil
+	}
+	fi, err := f.f.Stat()
+	t.begin(i, evStat)
+	t.putFileInfo(fi, err)
+	t.end()
+	return fi, err
+}
+
+func (f *tapeFile) Close() error {
+	i, t := f.i, f.i.tape
+	if t.replaying() {
+		t.next(i, evClose)
+		return t.error("close", "")
+	}
+	err := f.f.Close()
+	t.begin(i, evClose)
+	t.putError(err)
+	t.end()
+	return err
+}
+
+// tapeFileInfo is the os.FileInfo returned by replayed Stat calls.
+type tapeFileInfo struct {
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *tapeFileInfo) Name() string       { return "" }
+func (fi *tapeFileInfo) Size() int64        { return fi.size }
+func (fi *tapeFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *tapeFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *tapeFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *tapeFileInfo) Sys() interface{}   { return nil }
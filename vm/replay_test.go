@@ -0,0 +1,114 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dobegor/ngaro/vm"
+	"github.com/pkg/errors"
+)
+
+// countWriter counts calls to Write.
+type countWriter struct {
+	w io.Writer
+	n int
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n++
+	return w.w.Write(p)
+}
+
+var replayTest = hostTest[:strings.LastIndex(hostTest, "1 1 call io ( EOF )")] + `
+		42 in
+		42 in
+		1 1 call io ( EOF )
+	`
+
+func TestRecordReplay(t *testing.T) {
+	var (
+		log bytes.Buffer
+		n   vm.Cell
+	)
+	counter := vm.BindInHandler(42, func(i *vm.Instance, p vm.Cell) error {
+		n++
+		i.Push(n)
+		return nil
+	})
+	h := vm.NewDeterministicHost(time.Unix(1478260800, 0), map[string]string{"HOME": "/home/rec"}, []byte("ok"), nil)
+	w := &countWriter{w: &log}
+	rec, err := runAsmImage(replayTest, "Record", vm.Delegate(h), vm.StringCodec(testCodec{}), counter, vm.Record(w))
+	if errors.Cause(err) != io.EOF {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	assertEqualI(t, "Record writes", 2, w.n) // magic and final flush
+	recorded := log.Bytes()
+
+	// replay with a different host and IN handler
+	h = vm.NewDeterministicHost(time.Unix(0, 0), nil, nil, nil)
+	rep, err := runAsmImage(replayTest, "Replay", vm.Delegate(h), vm.StringCodec(testCodec{}), counter,
+		vm.Replay(bytes.NewReader(recorded)))
+	if errors.Cause(err) != io.EOF {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	assertEqualI(t, "Replay insCount", int(rec.InstructionCount()), int(rep.InstructionCount()))
+	assertEqual(t, "Replay data", fmt.Sprint(rec.Data()), fmt.Sprint(rep.Data()))
+	assertEqual(t, "Replay env", "/home/rec", string(testCodec{}.Decode(rep.Mem, 96)))
+	assertEqualI(t, "Replay IN handler calls", 2, int(n))
+
+	// divergence
+	_, err = runAsmImage("1 "+replayTest, "Replay", vm.StringCodec(testCodec{}), vm.Replay(bytes.NewReader(recorded)))
+	if err == nil || !strings.Contains(err.Error(), "diverged") {
+		t.Fatalf("Expected divergence error, got: %v", err)
+	}
+
+	_, err = vm.New(nil, "", vm.Replay(strings.NewReader("garbage")))
+	if err == nil {
+		t.Fatal("Unexpected nil error")
+	}
+}
+
+func TestReplay_corrupt(t *testing.T) {
+	prog := `jump start
+		.org 32
+		:name .dat "HOME"
+		:buf .dat 0 0 0 0
+		:start
+			lit buf lit name -10 5 out 0 0 out wait 5 in`
+	var log bytes.Buffer
+	h := vm.NewDeterministicHost(time.Unix(0, 0), map[string]string{"HOME": "x"}, nil, nil)
+	if _, err := runAsmImage(prog, "Record", vm.Delegate(h), vm.StringCodec(testCodec{}), vm.Record(&log)); err != nil {
+		t.Fatal(err)
+	}
+	// replace the length of the recorded value with a huge one
+	b := log.Bytes()
+	if !bytes.HasSuffix(b, []byte{1, 'x'}) {
+		t.Fatalf("Unexpected record: %q", b)
+	}
+	b = binary.AppendUvarint(b[:len(b)-2], 1<<40)
+	_, err := runAsmImage(prog, "Replay", vm.StringCodec(testCodec{}), vm.Replay(bytes.NewReader(b)))
+	if exp := "replay failed: unexpected EOF"; err == nil || !strings.HasSuffix(err.Error(), exp) {
+		t.Fatalf("Expected error %q, got: %v", exp, err)
+	}
+}
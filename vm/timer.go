@@ -0,0 +1,216 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"sync"
+	"time"
+)
+
+// Timer binds a timer device to the given WAIT port. The suggested port is 12.
+// The following requests are supported (stack effects in parentheses):
+//
+//	1  nanoseconds   ( -- ns )
+//	2  milliseconds  ( -- ms )
+//	3  sleep         ( ms -- 0 )
+//	4  one-shot      ( ms -- td )
+//	5  periodic      ( ms -- td )
+//	6  pending       ( td -- n )
+//	7  wait          ( td -- n )
+//	8  cancel        ( td -- f )
+//	9  date          ( dst -- 0 )
+//
+// Nanoseconds and milliseconds return the time elapsed since the first request
+// to the device, as measured by a monotonic clock.
+//
+// One-shot and periodic create a timer that expires once after the given
+// number of milliseconds, or repeatedly at that interval, and return a timer
+// descriptor, or 0 if the interval is not positive. Since the VM does not
+// support interrupts, timer expirations must be polled: pending returns the
+// number of times the timer has expired since the last pending or wait request
+// and resets it to 0. Wait sleeps until the timer expires, unless it already
+// has, then behaves like pending. It returns 0 immediately if the timer is a
+// one-shot timer that has already been reported. Cancel deletes a timer and
+// returns 0 on success, 1 on failure.
+//
+// Date stores the following fields of the current date and time in consecutive
+// cells at dst: year, month (1-12), day of month, hour, minute, second,
+// nanosecond, day of week (0 is Sunday), day of the year and offset of the time
+// zone from UTC in seconds.
+//
+// All time measurements and sleeps go through the instance's Clock (see
+// Delegate). With a deterministic Host, sleeping only advances the clock.
+//
+// The timers belong to the device. They are shared by clones of the instance
+// (see Clone).
+func Timer(port Cell) Option {
+	return func(i *Instance) error {
+		d := &timerDevice{timers: make(map[Cell]*timer), next: 1}
+		i.bindWaitHandler(port, d.wait)
+		return nil
+	}
+}
+
+type timer struct {
+	next   time.Time // next expiration, zero if none
+	period time.Duration
+}
+
+// expired returns the number of expirations of t at time now since the last
+// call.
+func (t *timer) expired(now time.Time) Cell {
+	if t.next.IsZero() || now.Before(t.next) {
+		return 0
+	}
+	if t.period == 0 {
+		t.next = time.Time{}
+		return 1
+	}
+	n := now.Sub(t.next)/t.period + 1
+	t.next = t.next.Add(n * t.period)
+	return Cell(n)
+}
+
+// timerDevice holds the state of a timer device. Since clones share their
+// devices, mu guards all fields, including the timers themselves.
+type timerDevice struct {
+	mu     sync.Mutex
+	start  time.Time
+	timers map[Cell]*timer
+	next   Cell
+}
+
+// now returns the current time and the time of the first request.
+func (d *timerDevice) now(i *Instance) (now, start time.Time) {
+	now = i.clock.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.start.IsZero() {
+		d.start = now
+	}
+	return now, d.start
+}
+
+func (d *timerDevice) add(t *timer) Cell {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for ; d.timers[d.next] != nil; d.next++ {
+	}
+	d.timers[d.next] = t
+	return d.next
+}
+
+func (d *timerDevice) get(i *Instance, td Cell) *timer {
+	d.mu.Lock()
+	t := d.timers[td]
+	d.mu.Unlock()
+	if t == nil {
+		i.errno = ErrnoBadFD
+	}
+	return t
+}
+
+func (d *timerDevice) wait(i *Instance, v, port Cell) error {
+	i.errno = ErrnoOK
+	var r Cell
+	switch v {
+	case 1, 2: // nanoseconds, milliseconds
+		r, _ = i.devCall(func() (Cell, []Cell) {
+			now, start := d.now(i)
+			el := now.Sub(start)
+			if v == 2 {
+				return Cell(el / time.Millisecond), nil
+			}
+			return Cell(el), nil
+		})
+	case 3: // sleep
+		ms := i.Pop()
+		i.devCall(func() (Cell, []Cell) {
+			i.clock.Sleep(time.Duration(ms) * time.Millisecond)
+			return 0, nil
+		})
+	case 4, 5: // one-shot, periodic
+		ms := i.Pop()
+		if ms <= 0 {
+			i.errno = ErrnoInvalid
+			break
+		}
+		r, _ = i.devCall(func() (Cell, []Cell) {
+			p := time.Duration(ms) * time.Millisecond
+			now, _ := d.now(i)
+			t := &timer{next: now.Add(p)}
+			if v == 5 {
+				t.period = p
+			}
+			return d.add(t), nil
+		})
+	case 6, 7: // pending, wait
+		td := i.Pop()
+		r, _ = i.devCall(func() (Cell, []Cell) {
+			t := d.get(i, td)
+			if t == nil {
+				return 0, nil
+			}
+			now, _ := d.now(i)
+			d.mu.Lock()
+			next := t.next
+			d.mu.Unlock()
+			if v == 7 && !next.IsZero() && now.Before(next) {
+				i.clock.Sleep(next.Sub(now))
+				now, _ = d.now(i)
+			}
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			return t.expired(now), nil
+		})
+	case 8: // cancel
+		td := i.Pop()
+		r, _ = i.devCall(func() (Cell, []Cell) {
+			if d.get(i, td) == nil {
+				return 1, nil
+			}
+			d.mu.Lock()
+			delete(d.timers, td)
+			if td < d.next {
+				d.next = td
+			}
+			d.mu.Unlock()
+			return 0, nil
+		})
+	case 9: // date
+		dst := i.Pop()
+		if !i.inMem(dst, 10) {
+			i.errno = ErrnoInvalid
+			break
+		}
+		_, f := i.devCall(func() (Cell, []Cell) {
+			t, _ := d.now(i)
+			_, off := t.Zone()
+			return 0, []Cell{
+				Cell(t.Year()), Cell(t.Month()), Cell(t.Day()),
+				Cell(t.Hour()), Cell(t.Minute()), Cell(t.Second()), Cell(t.Nanosecond()),
+				Cell(t.Weekday()), Cell(t.YearDay()), Cell(off),
+			}
+		})
+		i.UnshareMem()
+		copy(i.Mem[dst:], f)
+	default:
+		i.errno = ErrnoInvalid
+	}
+	i.WaitReply(r, port)
+	return nil
+}
@@ -0,0 +1,97 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm_test
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dobegor/ngaro/asm"
+	"github.com/dobegor/ngaro/vm"
+)
+
+func TestTimer(t *testing.T) {
+	start := time.Date(2016, 11, 4, 12, 30, 15, 0, time.FixedZone("CET", 3600))
+	h := vm.NewDeterministicHost(start, nil, nil, nil)
+	i, err := runAsmImage(`jump start
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:tm 12 call io ;
+		:p .dat 0
+		:o .dat 0
+		.org 64
+		:date
+		.org 80
+		:start
+			2 call tm
+			1500 3 call tm drop
+			2 call tm
+			1 call tm
+			100 5 call tm lit p !
+			1000 4 call tm lit o !
+			350 3 call tm drop
+			lit p @ 6 call tm
+			lit p @ 6 call tm
+			lit p @ 7 call tm
+			2 call tm
+			lit o @ 7 call tm
+			lit o @ 7 call tm
+			lit o @ 8 call tm
+			lit o @ 8 call tm
+			0 4 call tm
+			lit date 9 call tm drop
+		`, "Timer", vm.Delegate(h), vm.Timer(12))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "Timer", "[0 1500 1500000000 3 0 1 1900 1 0 0 1 0]", fmt.Sprint(i.Data()))
+	assertEqual(t, "Timer date", "[2016 11 4 12 30 17 500000000 5 309 3600]", fmt.Sprint(i.Mem[64:74]))
+}
+
+func TestTimer_clone(t *testing.T) {
+	img, err := asm.Assemble("Timer_clone", strings.NewReader(`jump start
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:tm 12 call io ;
+		:start
+			1 call tm drop
+			`+strings.Repeat("1 5 call tm dup 6 call tm drop 8 call tm drop\n", 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := vm.New(img, "", vm.Timer(12))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// clones share the device and run concurrently
+	var wg sync.WaitGroup
+	for k := 0; k < 4; k++ {
+		c := i.Clone()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Run(); err != nil {
+				t.Error(err)
+			}
+			assertEqual(t, "Timer_clone", "[]", fmt.Sprint(c.Data()))
+		}()
+	}
+	wg.Wait()
+}
@@ -18,7 +18,8 @@ package vm
 
 import (
 	"io"
-	"os"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -47,21 +48,36 @@ type Instance struct {
 	data      []Cell
 	address   []Cell
 	insCount  int64
+	insBase   int64 // instructions executed by previous calls to Run
 	inH       map[Cell]InHandler
 	outH      map[Cell]OutHandler
 	waitH     map[Cell]WaitHandler
+	waitP     []Cell
 	sEnc      Codec
 	opHandler OpcodeHandler
 	imageFile string
 	input     io.Reader
 	output    Terminal
+	clock     Clock
+	env       Env
+	fs        FS
 	fid       Cell
-	files     map[Cell]*os.File
+	files     map[Cell]File
 	memDump   func(string, []Cell) error
 	tickMask  int64
 	tickFn    func(i *Instance)
+	stopMu    sync.Mutex
+	stopReq   int32
 	stopped   bool
 	stopCh    chan struct{}
+	share     *memShare
+	tape      *tape
+	policy    PolicyFunc
+	errno     Errno
+	devCaps   map[Cell]Cell
+	mouse     *mouse
+	keyboard  *keyboard
+	bridge    *bridge
 }
 
 // An Option is a function for setting a VM Instance's options in New.
@@ -279,13 +295,27 @@ func BindOutHandler(port Cell, handler OutHandler) Option {
 //
 // Upon completion, a WAIT handler should call the WaitReply method which will
 // set the value of the bound port and set the value of port 0 to 1.
+//
+// WAIT handlers are called in increasing port order.
 func BindWaitHandler(port Cell, handler WaitHandler) Option {
 	return func(i *Instance) error {
-		i.waitH[port] = handler
+		i.bindWaitHandler(port, handler)
 		return nil
 	}
 }
 
+// bindWaitHandler binds a WAIT handler and keeps the list of bound ports
+// sorted so that handlers are always called in the same order.
+func (i *Instance) bindWaitHandler(port Cell, handler WaitHandler) {
+	if _, ok := i.waitH[port]; !ok {
+		n := sort.Search(len(i.waitP), func(k int) bool { return i.waitP[k] >= port })
+		i.waitP = append(i.waitP, 0)
+		copy(i.waitP[n+1:], i.waitP[n:])
+		i.waitP[n] = port
+	}
+	i.waitH[port] = handler
+}
+
 // OpcodeHandler is the prototype for opcode handler functions. When an opcode
 // handler is called, the VM's PC points to the opcode. Opcode handlers must take
 // care of updating the VM's PC.
@@ -307,8 +337,9 @@ func BindOpcodeHandler(handler OpcodeHandler) Option {
 // specified Codec. This is needed in file I/O where filenames are read from
 // memory. Clients that make use of these I/O calls must configure a
 // StringCodec. For Retro style encoding (one byte per Cell, 0 terminated),
-// retro.StringCodec can be used as Codec. Implementations using othe encoding
-// schemes, must provide their own Codec.
+// ByteCodec can be used as Codec. CountedCodec, UTF32Codec and PackedCodec
+// implement other common encoding schemes. Implementations using other
+// encoding schemes must provide their own Codec.
 func StringCodec(e Codec) Option {
 	return func(i *Instance) error {
 		i.sEnc = e
@@ -344,14 +375,17 @@ func New(mem []Cell, imageFile string, opts ...Option) (*Instance, error) {
 		outH:      make(map[Cell]OutHandler),
 		waitH:     make(map[Cell]WaitHandler),
 		imageFile: imageFile,
-		files:     make(map[Cell]*os.File),
+		clock:     osHost{},
+		env:       osHost{},
+		fs:        osHost{},
+		files:     make(map[Cell]File),
 		fid:       1,
 		memDump:   func(filename string, mem []Cell) error { return Save(filename, mem, 0) },
 	}
 
 	// default Wait Handlers
 	for _, p := range []Cell{1, 2, 4, 5, 8} {
-		i.waitH[p] = (*Instance).Wait
+		i.bindWaitHandler(p, (*Instance).Wait)
 	}
 
 	if err := i.SetOptions(opts...); err != nil {
@@ -390,3 +424,9 @@ func (i *Instance) Address() []Cell {
 func (i *Instance) InstructionCount() int64 {
 	return i.insCount
 }
+
+// position returns the number of instructions executed since the instance was
+// created. Unlike InstructionCount, it is not reset by Run.
+func (i *Instance) position() int64 {
+	return i.insBase + i.insCount
+}
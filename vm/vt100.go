@@ -0,0 +1,390 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm
+
+import (
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Character attributes of screen cells.
+const (
+	AttrBold = 1 << iota
+	AttrUnderline
+	AttrReverse
+)
+
+// ScreenCell is a character cell of a Screen. Fg and Bg are color numbers in
+// the range [0, 7], or -1 for the default color.
+type ScreenCell struct {
+	Rune   rune
+	Fg, Bg int
+	Attr   int
+}
+
+// Screen is a snapshot of the contents of a VT100Emulator.
+type Screen struct {
+	Width, Height int
+	X, Y          int          // cursor position, 0 based
+	Cells         []ScreenCell // Width * Height cells, row by row
+}
+
+// At returns the cell at column x and row y, 0 based.
+func (s *Screen) At(x, y int) ScreenCell {
+	return s.Cells[y*s.Width+x]
+}
+
+// Line returns the text of row y with trailing spaces removed.
+func (s *Screen) Line(y int) string {
+	var b strings.Builder
+	for _, c := range s.Cells[y*s.Width : (y+1)*s.Width] {
+		b.WriteRune(c.Rune)
+	}
+	return strings.TrimRight(b.String(), " ")
+}
+
+// String returns the text of the screen, one line per row, with trailing
+// spaces and empty lines at the bottom removed.
+func (s *Screen) String() string {
+	var b strings.Builder
+	for y := 0; y < s.Height; y++ {
+		b.WriteString(s.Line(y))
+		b.WriteByte('\n')
+	}
+	return strings.TrimRight(b.String(), "\n") + "\n"
+}
+
+// VT100Emulator is a headless Terminal that interprets the characters and
+// escape sequences written to it into an in-memory grid of character cells.
+// Its Clear, MoveCursor, FgColor and BgColor methods emit the same escape
+// sequences as the Terminal returned by NewVT100Terminal, so that the screen
+// contents match what a real VT100 compatible terminal would display.
+//
+// The following control characters and sequences are supported: CR, LF, BS,
+// TAB, ESC c (reset), and the CSI sequences for cursor movement (A, B, C, D, H
+// and f), erasing (J and K) and character attributes (m, with bold, underline,
+// reverse video and colors 30-37, 39, 40-47 and 49). Other sequences are
+// ignored. Since guests usually expect the terminal to translate newlines,
+// LF also moves the cursor to the first column. Text wraps at the right
+// margin and the screen scrolls up when the cursor moves past the last row.
+// CSI sequences with more than 32 parameter bytes are abandoned and the bytes
+// that follow are displayed as text. Invalid UTF-8 bytes are displayed as
+// U+FFFD.
+//
+// A VT100Emulator is safe for concurrent use: Screen can be called while the
+// VM is writing to it.
+type VT100Emulator struct {
+	mu    sync.Mutex
+	s     Screen
+	pen   ScreenCell
+	wrap  bool   // cursor past the right margin
+	state int    // parser state
+	seq   []byte // pending escape sequence or UTF-8 bytes
+}
+
+// Limits of the escape sequence parser. Longer CSI sequences are dropped and
+// larger parameters are saturated.
+const (
+	vtMaxSeq   = 32
+	vtMaxParam = 9999
+)
+
+// Parser states.
+const (
+	vtGround = iota
+	vtEsc
+	vtCSI
+)
+
+// NewVT100Emulator returns a new VT100Emulator with a screen of the given
+// size. The screen is initially blank and the cursor is in the top left
+// corner. Negative sizes are treated as 0.
+func NewVT100Emulator(width, height int) *VT100Emulator {
+	if width < 0 {
+		width = 0
+	}
+	if height < 0 {
+		height = 0
+	}
+	t := &VT100Emulator{s: Screen{Width: width, Height: height, Cells: make([]ScreenCell, width*height)}}
+	t.reset()
+	return t
+}
+
+// Screen returns a snapshot of the screen contents.
+func (t *VT100Emulator) Screen() *Screen {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.s
+	s.Cells = append([]ScreenCell(nil), t.s.Cells...)
+	return &s
+}
+
+// String returns a text dump of the screen (see Screen.String).
+func (t *VT100Emulator) String() string {
+	return t.Screen().String()
+}
+
+// Write interprets the characters and escape sequences in b. It never fails.
+func (t *VT100Emulator) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, c := range b {
+		t.put(c)
+	}
+	return len(b), nil
+}
+
+// Flush does nothing.
+func (t *VT100Emulator) Flush() error { return nil }
+
+// Size returns the size of the screen.
+func (t *VT100Emulator) Size() (width int, height int) { return t.s.Width, t.s.Height }
+
+// Clear clears the screen and moves the cursor to the top left corner.
+func (t *VT100Emulator) Clear() { t.Write([]byte("\033[2J\033[1;1H")) }
+
+// MoveCursor moves the cursor to row x, column y, both 1 based, like the
+// Terminal returned by NewVT100Terminal.
+func (t *VT100Emulator) MoveCursor(x, y int) {
+	(&vt100Terminal{Writer: t}).MoveCursor(x, y)
+}
+
+// FgColor sets the foreground color.
+func (t *VT100Emulator) FgColor(fg int) { (&vt100Terminal{Writer: t}).FgColor(fg) }
+
+// BgColor sets the background color.
+func (t *VT100Emulator) BgColor(bg int) { (&vt100Terminal{Writer: t}).BgColor(bg) }
+
+// Port8Enabled returns true.
+func (t *VT100Emulator) Port8Enabled() bool { return true }
+
+func (t *VT100Emulator) reset() {
+	t.pen = ScreenCell{Rune: ' ', Fg: -1, Bg: -1}
+	t.erase(0, len(t.s.Cells))
+	t.s.X, t.s.Y, t.wrap = 0, 0, false
+}
+
+// erase clears the cells in the range [from, to) with the current colors.
+func (t *VT100Emulator) erase(from, to int) {
+	c := ScreenCell{Rune: ' ', Fg: t.pen.Fg, Bg: t.pen.Bg}
+	for k := from; k < to; k++ {
+		t.s.Cells[k] = c
+	}
+}
+
+func (t *VT100Emulator) put(c byte) {
+	switch t.state {
+	case vtEsc:
+		t.state = vtGround
+		switch c {
+		case '[':
+			t.state, t.seq = vtCSI, t.seq[:0]
+		case 'c':
+			t.reset()
+		}
+		return
+	case vtCSI:
+		if c == '\033' {
+			t.state = vtEsc
+		} else if c >= 0x40 && c <= 0x7e {
+			t.state = vtGround
+			t.csi(c, t.params())
+			t.seq = t.seq[:0]
+		} else if len(t.seq) < vtMaxSeq {
+			t.seq = append(t.seq, c)
+		} else {
+			t.state, t.seq = vtGround, t.seq[:0]
+		}
+		return
+	}
+	if len(t.seq) > 0 || c >= utf8.RuneSelf {
+		t.seq = append(t.seq, c)
+		if !utf8.FullRune(t.seq) {
+			return
+		}
+		// bytes following an invalid UTF-8 sequence are interpreted again
+		r, n := utf8.DecodeRune(t.seq)
+		var rest [utf8.UTFMax]byte
+		k := copy(rest[:], t.seq[n:])
+		t.seq = t.seq[:0]
+		t.print(r)
+		for _, c := range rest[:k] {
+			t.put(c)
+		}
+		return
+	}
+	switch c {
+	case '\033':
+		t.state = vtEsc
+	case '\r':
+		t.s.X, t.wrap = 0, false
+	case '\n':
+		t.s.X, t.wrap = 0, false
+		t.lineFeed()
+	case '\b':
+		if t.s.X > 0 {
+			t.s.X--
+		}
+		t.wrap = false
+	case '\t':
+		if t.s.Width == 0 {
+			break
+		}
+		t.s.X = (t.s.X + 8) &^ 7
+		if t.s.X >= t.s.Width {
+			t.s.X = t.s.Width - 1
+		}
+	default:
+		if c >= ' ' && c != 0x7f {
+			t.print(rune(c))
+		}
+	}
+}
+
+func (t *VT100Emulator) print(r rune) {
+	if t.s.Width == 0 || t.s.Height == 0 {
+		return
+	}
+	if t.wrap {
+		t.s.X, t.wrap = 0, false
+		t.lineFeed()
+	}
+	c := t.pen
+	c.Rune = r
+	t.s.Cells[t.s.Y*t.s.Width+t.s.X] = c
+	if t.s.X == t.s.Width-1 {
+		t.wrap = true
+	} else {
+		t.s.X++
+	}
+}
+
+func (t *VT100Emulator) lineFeed() {
+	if t.s.Y < t.s.Height-1 {
+		t.s.Y++
+		return
+	}
+	if len(t.s.Cells) == 0 {
+		return
+	}
+	copy(t.s.Cells, t.s.Cells[t.s.Width:])
+	t.erase(len(t.s.Cells)-t.s.Width, len(t.s.Cells))
+}
+
+// params parses the numeric parameters of a CSI sequence.
+func (t *VT100Emulator) params() []int {
+	p := []int{0}
+	for _, c := range t.seq {
+		switch {
+		case c >= '0' && c <= '9':
+			if v := p[len(p)-1]*10 + int(c-'0'); v <= vtMaxParam {
+				p[len(p)-1] = v
+			} else {
+				p[len(p)-1] = vtMaxParam
+			}
+		case c == ';':
+			p = append(p, 0)
+		}
+	}
+	return p
+}
+
+func (t *VT100Emulator) csi(f byte, p []int) {
+	if t.s.Width == 0 || t.s.Height == 0 {
+		return
+	}
+	// n returns parameter k, or 1 if it is missing or 0.
+	n := func(k int) int {
+		if k < len(p) && p[k] > 0 {
+			return p[k]
+		}
+		return 1
+	}
+	w, h := t.s.Width, t.s.Height
+	t.wrap = false
+	switch f {
+	case 'A':
+		t.s.Y = clamp(t.s.Y-n(0), 0, h-1)
+	case 'B':
+		t.s.Y = clamp(t.s.Y+n(0), 0, h-1)
+	case 'C':
+		t.s.X = clamp(t.s.X+n(0), 0, w-1)
+	case 'D':
+		t.s.X = clamp(t.s.X-n(0), 0, w-1)
+	case 'H', 'f':
+		t.s.Y, t.s.X = clamp(n(0)-1, 0, h-1), clamp(n(1)-1, 0, w-1)
+	case 'J':
+		k := t.s.Y*w + t.s.X
+		switch p[0] {
+		case 0:
+			t.erase(k, len(t.s.Cells))
+		case 1:
+			t.erase(0, k+1)
+		case 2:
+			t.erase(0, len(t.s.Cells))
+		}
+	case 'K':
+		k := t.s.Y * w
+		switch p[0] {
+		case 0:
+			t.erase(k+t.s.X, k+w)
+		case 1:
+			t.erase(k, k+t.s.X+1)
+		case 2:
+			t.erase(k, k+w)
+		}
+	case 'm':
+		for _, v := range p {
+			switch {
+			case v == 0:
+				t.pen = ScreenCell{Rune: ' ', Fg: -1, Bg: -1}
+			case v == 1:
+				t.pen.Attr |= AttrBold
+			case v == 4:
+				t.pen.Attr |= AttrUnderline
+			case v == 7:
+				t.pen.Attr |= AttrReverse
+			case v == 22:
+				t.pen.Attr &^= AttrBold
+			case v == 24:
+				t.pen.Attr &^= AttrUnderline
+			case v == 27:
+				t.pen.Attr &^= AttrReverse
+			case v >= 30 && v <= 37:
+				t.pen.Fg = v - 30
+			case v == 39:
+				t.pen.Fg = -1
+			case v >= 40 && v <= 47:
+				t.pen.Bg = v - 40
+			case v == 49:
+				t.pen.Bg = -1
+			}
+		}
+	}
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
@@ -0,0 +1,92 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vm_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dobegor/ngaro/vm"
+)
+
+func TestVT100Emulator(t *testing.T) {
+	e := vm.NewVT100Emulator(10, 3)
+	fmt.Fprint(e, "hello\nwörld")
+	assertEqual(t, "Text", "hello\nwörld\n", e.String())
+	s := e.Screen()
+	assertEqual(t, "Cursor", "5 1", fmt.Sprint(s.X, s.Y))
+
+	e.Clear()
+	e.MoveCursor(2, 4)
+	e.FgColor(1)
+	e.BgColor(4)
+	fmt.Fprint(e, "red\033[1mB\033[0m.")
+	s = e.Screen()
+	assertEqual(t, "MoveCursor", "\n   redB.\n", s.String())
+	assertEqual(t, "Colors", "{114 1 4 0}", fmt.Sprint(s.At(3, 1)))
+	assertEqual(t, "Bold", fmt.Sprint(vm.ScreenCell{Rune: 'B', Fg: 1, Bg: 4, Attr: vm.AttrBold}), fmt.Sprint(s.At(6, 1)))
+	assertEqual(t, "Reset", "{46 -1 -1 0}", fmt.Sprint(s.At(7, 1)))
+
+	// erase, wrap and scroll
+	fmt.Fprint(e, "\033[2;5H\033[K\033[3;1Habcdefghijkl\033[A\033[3C*")
+	assertEqual(t, "Scroll", "   r\nabcde*ghij\nkl\n", e.String())
+
+	// split escape sequences and UTF-8 characters
+	e = vm.NewVT100Emulator(4, 2)
+	for _, c := range []byte("\033[2;2Hé") {
+		e.Write([]byte{c})
+	}
+	assertEqual(t, "Split", "\n é\n", e.String())
+
+	// invalid UTF-8, oversized parameters and sequences
+	e = vm.NewVT100Emulator(10, 3)
+	fmt.Fprint(e, "\xc3a\033[99999999999999999999;3Hb\033["+strings.Repeat(";", 36)+"A")
+	assertEqual(t, "Invalid", "\ufffda\n\n  b;;;A\n", e.String())
+
+	// zero-sized screens ignore output
+	for _, sz := range [][2]int{{0, 0}, {4, 0}, {0, 2}, {-1, -1}} {
+		e = vm.NewVT100Emulator(sz[0], sz[1])
+		fmt.Fprint(e, "ab\033[1J\033[1K\033[J\033[2K\033[5;5H\033[Bc\n\t")
+		e.Clear()
+		s = e.Screen()
+		assertEqual(t, fmt.Sprint("Empty ", sz), "\n", s.String())
+		if s.X < 0 || s.Y < 0 {
+			t.Errorf("Empty %v: cursor at %d, %d", sz, s.X, s.Y)
+		}
+	}
+}
+
+func TestVT100Emulator_vm(t *testing.T) {
+	e := vm.NewVT100Emulator(8, 3)
+	_, err := runAsmImage(`jump start
+		.org 32
+		:io dup push out 0 0 out wait pop in ;
+		:emit 1 2 call io drop ;
+		:start
+		-1 call emit
+		4 2 1 8 call io drop
+		3 2 8 call io drop
+		'o' call emit 'k' call emit
+		`, "VT100", vm.Output(e))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := e.Screen()
+	assertEqual(t, "VM", "\n   ok\n", s.String())
+	assertEqual(t, "VM color", "3", fmt.Sprint(s.At(3, 1).Fg))
+}
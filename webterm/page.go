@@ -0,0 +1,72 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webterm
+
+// page is the HTML page of the terminal. It uses xterm.js for display and
+// implements line editing on the browser side.
+const page = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>ngaro</title>
+<link rel="stylesheet" href="https://cdn.jsdelivr.net/npm/@xterm/xterm@5.5.0/css/xterm.css">
+<script src="https://cdn.jsdelivr.net/npm/@xterm/xterm@5.5.0/lib/xterm.js"></script>
+<style>body { margin: 0; background: #000; } #term { padding: 8px; }</style>
+</head>
+<body>
+<div id="term"></div>
+<script>
+(function() {
+	var term = new Terminal({cols: {{.Width}}, rows: {{.Height}}, convertEol: true});
+	term.open(document.getElementById("term"));
+	term.focus();
+
+	var url = new URL("ws", location.href.replace(/\/?([?#].*)?$/, "/"));
+	url.protocol = location.protocol === "https:" ? "wss:" : "ws:";
+	var ws = new WebSocket(url);
+	ws.binaryType = "arraybuffer";
+	var dec = new TextDecoder();
+	ws.onmessage = function(e) {
+		term.write(dec.decode(e.data, {stream: true}));
+	};
+	ws.onclose = function() {
+		term.write("\r\n[disconnected]\r\n");
+	};
+
+	var line = "";
+	term.onData(function(d) {
+		for (var c of d) {
+			if (c === "\r") {
+				term.write("\r\n");
+				ws.send(line + "\n");
+				line = "";
+			} else if (c === "\x7f" || c === "\b") {
+				if (line.length > 0) {
+					line = Array.from(line).slice(0, -1).join("");
+					term.write("\b \b");
+				}
+			} else if (c >= " ") {
+				line += c;
+				term.write(c);
+			}
+		}
+	});
+})();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,217 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package webterm serves a browser based terminal for ngaro VMs.
+//
+// The handler returned by Handler serves an HTML page with a terminal and a
+// WebSocket endpoint. Each WebSocket connection gets its own VM instance,
+// created from a copy of a base image. The output of the VM is sent to the
+// browser and the text typed in the browser is fed to the VM as input.
+//
+// The browser side emulates a terminal in line mode: typed characters are
+// echoed locally and sent to the VM one line at a time when Enter is pressed.
+package webterm
+
+import (
+	"bufio"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/dobegor/ngaro/vm"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// maxPending is the maximum number of messages received from the browser and
+// not yet read by the VM. The browser sends one message per line of input.
+const maxPending = 64
+
+// Config configures a web terminal.
+type Config struct {
+	Image   []vm.Cell   // base image, copied for each connection
+	Options []vm.Option // additional options applied to each VM instance
+	Width   int         // terminal width, 80 if 0
+	Height  int         // terminal height, 24 if 0
+
+	// CheckOrigin is used to check the origin of WebSocket requests. If nil,
+	// only requests from the same host are accepted.
+	CheckOrigin func(r *http.Request) bool
+}
+
+type handler struct {
+	cfg  Config
+	up   websocket.Upgrader
+	page *template.Template
+}
+
+// Handler returns an http.Handler that serves the terminal page at its root
+// and the WebSocket endpoint at "ws", relative to the page URL.
+//
+// For each WebSocket connection, a new VM is created from a copy of
+// cfg.Image with the options in cfg.Options, and run until it exits or the
+// connection is closed. Options that are bound to a specific resource (like
+// Canvas or FileSystem) are shared by all VM instances. When the browser
+// disconnects, or sends more than 64 lines of input that the VM does not read,
+// the VM input is closed and the VM is stopped.
+func Handler(cfg Config) http.Handler {
+	if cfg.Width == 0 {
+		cfg.Width = 80
+	}
+	if cfg.Height == 0 {
+		cfg.Height = 24
+	}
+	h := &handler{
+		cfg:  cfg,
+		up:   websocket.Upgrader{CheckOrigin: cfg.CheckOrigin},
+		page: template.Must(template.New("page").Parse(page)),
+	}
+	return h
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch path.Base(r.URL.Path) {
+	case "ws":
+		h.serveWS(w, r)
+	default:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		h.page.Execute(w, h.cfg)
+	}
+}
+
+func (h *handler) serveWS(w http.ResponseWriter, r *http.Request) {
+	c, err := h.up.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade already replied with an error
+	}
+	defer c.Close()
+
+	out := &output{c: c, w: bufio.NewWriter(conn{c})}
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	size := func() (int, int) { return h.cfg.Width, h.cfg.Height }
+	opts := append([]vm.Option{
+		vm.Input(&input{r: pr, out: out}),
+		vm.Output(vm.NewVT100Terminal(out, out.Flush, size)),
+	}, h.cfg.Options...)
+	i, err := vm.New(append([]vm.Cell(nil), h.cfg.Image...), "", opts...)
+	if err != nil {
+		out.close(err)
+		return
+	}
+
+	// The connection is read independently of the VM input so that a
+	// disconnection is noticed even if the guest does not read its input.
+	msgs := make(chan []byte, maxPending)
+	go func() {
+		defer close(msgs)
+		for {
+			_, msg, err := c.ReadMessage()
+			if err == nil {
+				select {
+				case msgs <- msg:
+					continue
+				default: // the guest is not reading its input
+				}
+			}
+			pw.Close()
+			i.Stop()
+			return
+		}
+	}()
+	go func() {
+		for msg := range msgs {
+			if _, err := pw.Write(msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	err = i.Run()
+	if errors.Cause(err) == io.EOF {
+		err = nil
+	}
+	out.close(err)
+}
+
+// conn sends the VM output to the browser as binary messages. Text messages
+// cannot be used since the output is not guaranteed to be valid UTF-8 when
+// flushed.
+type conn struct {
+	c *websocket.Conn
+}
+
+func (c conn) Write(b []byte) (int, error) {
+	if err := c.c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// output buffers the VM output.
+type output struct {
+	c *websocket.Conn
+	w *bufio.Writer
+}
+
+// Write implements io.Writer for the VM. Output is flushed at the end of
+// every line.
+func (o *output) Write(b []byte) (int, error) {
+	if o.w == nil {
+		return 0, errors.New("write on closed terminal")
+	}
+	n, err := o.w.Write(b)
+	if err == nil && len(b) > 0 && b[len(b)-1] == '\n' {
+		err = o.w.Flush()
+	}
+	return n, err
+}
+
+// Flush sends the buffered output to the browser.
+func (o *output) Flush() error {
+	if o.w == nil {
+		return nil
+	}
+	return o.w.Flush()
+}
+
+// close flushes pending output, reports err, if any, and closes the
+// connection.
+func (o *output) close(err error) {
+	o.Flush()
+	o.w = nil
+	if err != nil {
+		fmt.Fprintf(conn{o.c}, "\r\n%v\r\n", err)
+	}
+	o.c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+// input reads VM input from the browser. Pending output is flushed before
+// waiting for input.
+type input struct {
+	r   io.Reader
+	out *output
+}
+
+func (i *input) Read(b []byte) (int, error) {
+	if err := i.out.Flush(); err != nil {
+		return 0, err
+	}
+	return i.r.Read(b)
+}
@@ -0,0 +1,143 @@
+// This file is part of ngaro - https://github.com/dobegor/ngaro
+//
+// Copyright 2016 Denis Bernard <db047h@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webterm_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dobegor/ngaro/asm"
+	"github.com/dobegor/ngaro/vm"
+	"github.com/dobegor/ngaro/webterm"
+	"github.com/gorilla/websocket"
+)
+
+// echo reads characters and writes them back in upper case.
+const echo = `jump start
+	:io dup push out 0 0 out wait pop in ;
+	:start
+		1 1 call io
+		dup 'a' <jump 1+
+		dup 'z' >jump 1+
+		32 -
+	:1	1 2 call io drop
+		jump start
+`
+
+func TestHandler(t *testing.T) {
+	img, err := asm.Assemble("echo", strings.NewReader(echo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(webterm.Handler(webterm.Config{Image: img, Width: 40}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if s := string(b); !strings.Contains(s, "new WebSocket") || !regexp.MustCompile(`cols:\s*40\b`).MatchString(s) {
+		t.Errorf("unexpected page contents:\n%s", s)
+	}
+
+	// two concurrent sessions
+	var cs [2]*websocket.Conn
+	for k := range cs {
+		c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		cs[k] = c
+	}
+	for k, line := range []string{"hello\n", "world\n"} {
+		if err = cs[k].WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for k, exp := range []string{"HELLO\n", "WORLD\n"} {
+		var out string
+		for len(out) < len(exp) {
+			_, msg, err := cs[k].ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			out += string(msg)
+		}
+		if out != exp {
+			t.Errorf("session %d: expected %q, got %q", k, exp, out)
+		}
+	}
+
+	// closing the input ends the session
+	cs[0].WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	for {
+		if _, _, err = cs[0].ReadMessage(); err != nil {
+			break
+		}
+	}
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("expected normal closure, got %v", err)
+	}
+}
+
+func TestHandler_disconnect(t *testing.T) {
+	// a guest that never reads its input
+	img, err := asm.Assemble("loop", strings.NewReader(":1 jump 1-"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ticks int64
+	tick := vm.Ticker(func(*vm.Instance) { atomic.AddInt64(&ticks, 1) }, 1024)
+	srv := httptest.NewServer(webterm.Handler(webterm.Config{Image: img, Options: []vm.Option{tick}}))
+	defer srv.Close()
+
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for atomic.LoadInt64(&ticks) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// input that is never read must not prevent disconnection
+	for k := 0; k < 3; k++ {
+		if err = c.WriteMessage(websocket.TextMessage, []byte("input\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Close()
+
+	// the VM must stop running
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		n := atomic.LoadInt64(&ticks)
+		time.Sleep(50 * time.Millisecond)
+		if atomic.LoadInt64(&ticks) == n {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("VM still running after disconnect")
+		}
+	}
+}